@@ -2,75 +2,790 @@
 package jwt
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/dgrijalva/jwt-go"
-	"log"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	defaultSigningAlgorithm = "HS256"
+	defaultTokenLookup      = "header:Authorization"
+	defaultTokenHeadName    = "Bearer"
+	defaultIdentityKey      = "id"
+	refreshTokenHeader      = "X-Refresh-Token"
+	defaultMaxTokenLength   = 8 << 10
+)
+
+var (
+	// ErrMissingAuthHeader is returned when the configured header is empty.
+	ErrMissingAuthHeader = errors.New("Auth header empty")
+
+	// ErrTokenNotFound is returned when the configured cookie or query parameter is empty.
+	ErrTokenNotFound = errors.New("Token not found")
+
+	// ErrInvalidAuthHeader is returned when the header does not carry the expected scheme.
+	ErrInvalidAuthHeader = errors.New("Invalid auth header")
+
+	// ErrInvalidSigningAlgorithm is returned when the token's alg differs from SigningAlgorithm.
+	ErrInvalidSigningAlgorithm = errors.New("Invalid signing algorithm")
+
+	// ErrInvalidSignature is returned when the token signature does not verify.
+	ErrInvalidSignature = errors.New("Invalid signature")
+
+	// ErrExpiredToken is returned when the token is past its exp claim.
+	ErrExpiredToken = errors.New("Token is expired")
+
+	// ErrTokenNotValidYet is returned when the token is before its nbf claim.
+	ErrTokenNotValidYet = errors.New("Token is not valid yet")
+
+	// ErrIssuedInFuture is returned when RejectFutureIat is set and the iat claim of the
+	// token lies in the future.
+	ErrIssuedInFuture = errors.New("Token is issued in the future")
+
+	// ErrTokenTooLarge is returned when the token is longer than MaxTokenLength.
+	ErrTokenTooLarge = errors.New("Token is too large")
+
+	// ErrInvalidToken is returned when the token can't be parsed nor decrypted.
+	ErrInvalidToken = errors.New("Invalid token")
+
+	// ErrMalformedToken is returned when the token isn't made of three base64url encoded
+	// segments holding a JSON header and claims.
+	ErrMalformedToken = errors.New("Malformed token")
+
+	// ErrInvalidIssuer is returned when the iss claim doesn't match Issuer.
+	ErrInvalidIssuer = errors.New("Invalid token issuer")
+
+	// ErrInvalidAudience is returned when the aud claim doesn't contain Audience.
+	ErrInvalidAudience = errors.New("Invalid token audience")
+
+	// ErrInvalidClaims is returned when a required claim is missing or has the wrong type.
+	ErrInvalidClaims = errors.New("Invalid token claims")
+
+	// ErrRefreshExpired is returned when the token is past orig_iat + MaxRefresh.
+	ErrRefreshExpired = errors.New("Token refresh window expired")
+
+	// ErrRefreshDisabled is returned by RefreshHandler when neither MaxRefresh nor
+	// RefreshTimeout is set.
+	ErrRefreshDisabled = errors.New("Token refresh is disabled")
+
+	// ErrRevokedToken is returned when the Revoked callback reports the token as revoked.
+	ErrRevokedToken = errors.New("Token has been revoked")
+
+	// ErrRefreshTokenReused is returned by RefreshHandler when RefreshTokenStore reports the
+	// refresh token as already used.
+	ErrRefreshTokenReused = errors.New("Refresh token has already been used")
+
+	// ErrInvalidTokenType is returned when a refresh token is used as access token or the
+	// other way around, when the typ header is set to anything but JWT or the typ claim
+	// isn't RequireClaimTyp.
+	ErrInvalidTokenType = errors.New("Invalid token type")
+
+	// ErrUnknownKey is returned when the kid header of the token matches no key of the JWKS.
+	ErrUnknownKey = errors.New("Unknown signing key")
+
+	// ErrKeyUnavailable is returned when KeyProvider fails to return the key or the JWKS
+	// can't be fetched.
+	ErrKeyUnavailable = errors.New("Key is unavailable")
+
+	// ErrForbidden is returned when the Authorizator denies the request.
+	ErrForbidden = errors.New("You don't have permission to access this resource")
+
+	// ErrInvalidLoginPayload is the reason of a login refused because its payload can't be
+	// decoded, replied with a 400.
+	ErrInvalidLoginPayload = errors.New("Invalid login payload")
+
+	// ErrFailedTokenCreation is returned when a new token can't be signed.
+	ErrFailedTokenCreation = errors.New("Failed to create token")
+
+	// ErrUserNotFound is returned when the Authenticator doesn't know the user.
+	ErrUserNotFound = errors.New("User does not exist")
+
+	// ErrIncorrectPassword is returned when the Authenticator refuses the password.
+	ErrIncorrectPassword = errors.New("Incorrect password")
+
+	// ErrInvalidClient is returned when the ClientAuthenticator refuses the credentials.
+	ErrInvalidClient = errors.New("Invalid client credentials")
+
+	// ErrAccountDisabled can be returned by AuthenticatorErr for a locked or disabled
+	// account, the login is refused with a 403 instead of a 401.
+	ErrAccountDisabled = errors.New("Account is disabled")
+)
+
+// Logger is the interface of the JWTMiddleware.Logger option, satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Metrics is the interface of the JWTMiddleware.Metrics option, e.g. backed by Prometheus
+// counters. Each request going through the middleware increments exactly one of them.
+type Metrics interface {
+	// IncSuccess counts the requests passed on to the handler.
+	IncSuccess()
+	// IncExpired counts the requests refused because the token has expired.
+	IncExpired()
+	// IncInvalid counts the requests refused for any other token problem: missing, bad
+	// signature, revoked, invalid claims...
+	IncInvalid()
+	// IncForbidden counts the authenticated requests the authorization denied.
+	IncForbidden()
+}
+
+// RefreshTokenStore is the interface of the JWTMiddleware.RefreshTokenStore option, making
+// refresh tokens single use. Each login starts a family of refresh tokens, identified by the
+// jti of its first refresh token, and every refresh replaces the token with the next one of
+// the family.
+type RefreshTokenStore interface {
+	// Consume marks the refresh token jti of the family familyId as used. It must return
+	// false when jti has been consumed before or the family has been revoked.
+	Consume(jti string, familyId string) bool
+	// RevokeFamily is called when a refresh token is presented twice, meaning it has
+	// leaked: no refresh token of the family must be accepted afterwards.
+	RevokeFamily(familyId string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncSuccess()   {}
+func (nopMetrics) IncExpired()   {}
+func (nopMetrics) IncInvalid()   {}
+func (nopMetrics) IncForbidden() {}
+
 // JWTMiddleware provides a Json-Web-Token authentication implementation. On failure, a 401 HTTP response
 // is returned. On success, the wrapped middleware is called, and the userId is made available as
-// request.Env["REMOTE_USER"].(string).
+// request.Env["REMOTE_USER"].(string). The full set of claims is made available as
+// request.Env["JWT_PAYLOAD"].(map[string]interface{}). Both are also stored in the context of the
+// request, see UserFromContext and ClaimsFromContext. The remaining lifetime of the token is
+// made available as request.Env["JWT_EXPIRES_IN"].(time.Duration). When IdentityHandler is set
+// REMOTE_USER holds the value it returns instead, the userId is always available as
+// request.Env["REMOTE_USER_ID"].(string). The alg and kid headers of the token are made
+// available as request.Env["JWT_ALG"].(string) and request.Env["JWT_KID"].(string), the latter
+// only when the token has one.
 // Users can get a token by posting a json request to LoginHandler. The token then needs to be passed in
 // the Authentication header. Example: Authorization:Bearer XXX_TOKEN_XXX
 type JWTMiddleware struct {
 	// Realm name to display to the user. Required.
 	Realm string
 
-	// signing algorithm - possible values are HS256, HS384, HS512
+	// Callback function returning the realm of the WWW-Authenticate challenge for the
+	// request, e.g. the tenant derived from the host. Realm is still required, it's
+	// only used when RealmFunc isn't set.
+	// Optional.
+	RealmFunc func(request *rest.Request) string
+
+	// signing algorithm - possible values are HS256, HS384, HS512, RS256, RS384, RS512,
+	// ES256, ES384, ES512
 	// Optional, default is HS256.
 	SigningAlgorithm string
 
-	// Secret key used for signing. Required.
+	// Additional algorithms accepted when verifying tokens, e.g. {"HS256"} while migrating
+	// from HS256 to an RS256 SigningAlgorithm. New tokens are always signed with
+	// SigningAlgorithm. HMAC algorithms are verified with Key, RS* and ES* ones with
+	// PublicKey, so RS* and ES* can't be mixed without KeyFunc.
+	// Optional.
+	ValidAlgorithms []string
+
+	// Secret key used for signing. Required for the HS* algorithms unless Keys is set.
 	Key []byte
 
+	// Secret keys for the HS* algorithms while rotating the secret. The first one is used
+	// for signing, tokens signed with any of them are accepted. Key is ignored when set.
+	// Optional.
+	Keys [][]byte
+
+	// Secret key for the HS* algorithms as a base64url string, padded or not, decoded into
+	// Key by Init. Ignored when Key is set.
+	// Optional.
+	KeyBase64 string
+
+	// Reader of the secret key for the HS* algorithms, e.g. an embedded file, read once by
+	// Init and used as is. Ignored when Key or KeyBase64 is set.
+	// Optional.
+	KeyReader io.Reader
+
+	// Callback function that returns the secret key for the HS* algorithms, e.g. fetched
+	// from a secret store, so it can be rotated without a restart. Used for signing and
+	// verifying instead of Key and Keys.
+	// Optional.
+	KeyProvider func() ([]byte, error)
+
+	// Duration the key returned by KeyProvider is cached for.
+	// Optional, defaults to 0 meaning KeyProvider is called for every token.
+	KeyProviderTTL time.Duration
+
+	// Callback function that returns the secret key for the HS* algorithms of the tenant a
+	// request belongs to, e.g. picked by its Host header. Used for signing the tokens issued
+	// by LoginHandler and RefreshHandler and for verifying the tokens of the request, so
+	// tokens of a tenant are refused by the others. Takes precedence over KeyProvider, Key
+	// and Keys; GenerateToken and VerifyToken can't be used as they have no request, an error
+	// makes the login fail and the token be refused with ErrKeyUnavailable.
+	// Optional.
+	KeyForRequest func(request *rest.Request) ([]byte, error)
+
+	// Private key used for signing tokens with the RS* and ES* algorithms, a *rsa.PrivateKey
+	// or an *ecdsa.PrivateKey respectively. Only needed by the service that issues tokens
+	// through LoginHandler and RefreshHandler.
+	PrivateKey crypto.PrivateKey
+
+	// Public key used for verifying tokens signed with the RS* and ES* algorithms, a
+	// *rsa.PublicKey or an *ecdsa.PublicKey respectively. Required for RS* and ES* unless
+	// PrivateKey is set, in which case it defaults to its public part.
+	PublicKey crypto.PublicKey
+
+	// Path of a PEM encoded private key for the RS* and ES* algorithms, read and parsed once
+	// by Init. Ignored when PrivateKey or PrivKeyPEM is set.
+	// Optional.
+	PrivKeyFile string
+
+	// Path of a PEM encoded public key for the RS* and ES* algorithms, read and parsed once
+	// by Init. Ignored when PublicKey or PubKeyPEM is set.
+	// Optional.
+	PubKeyFile string
+
+	// PEM encoded private key for the RS* and ES* algorithms, e.g. taken from an environment
+	// variable, parsed once by Init. Ignored when PrivateKey is set.
+	// Optional.
+	PrivKeyPEM string
+
+	// PEM encoded public key for the RS* and ES* algorithms, parsed once by Init. Ignored
+	// when PublicKey is set.
+	// Optional.
+	PubKeyPEM string
+
+	// Readers of the PEM encoded private and public keys for the RS* and ES* algorithms, read
+	// and parsed once by Init. Take precedence over PrivKeyFile and PubKeyFile, ignored when
+	// the key or its PEM string is set.
+	// Optional.
+	PrivKeyReader io.Reader
+	PubKeyReader  io.Reader
+
+	// File system PrivKeyFile and PubKeyFile are read from, e.g. an embed.FS or a
+	// fstest.MapFS, the paths being then relative to its root as fs.ValidPath requires.
+	// Optional, by default the files are read from the OS file system.
+	KeyFS fs.FS
+
+	// URL of the JWKS document of an external identity provider. When set the middleware
+	// only validates tokens: the key is picked from the document by the kid header of the
+	// token and no local key nor Authenticator is needed, LoginHandler and RefreshHandler
+	// reply with a 404. SigningAlgorithm must be one of RS* or ES*.
+	// Optional.
+	JWKSURL string
+
+	// Duration after which the JWKS document is fetched again.
+	// Optional, default is one hour.
+	JWKSRefreshInterval time.Duration
+
+	// Minimum delay between two fetches of the JWKS document. Tokens with an unknown kid
+	// trigger a fetch in case the keys have been rotated, at most once per interval.
+	// Optional, default is one minute.
+	JWKSMinRefreshInterval time.Duration
+
+	// Set to true to decode the tokens without verifying their signature, for services behind
+	// a gateway that already verified them. exp, nbf, the alg header and the other claim
+	// checks still apply, and no key is required to verify tokens.
+	// WARNING: anyone able to reach the service without going through the gateway can then
+	// forge tokens for any user. Only enable it when the network guarantees every request
+	// has been checked upstream, and never on a service exposed directly.
+	// Optional, default is false.
+	TrustUpstream bool
+
+	// Callback function that returns the key used to verify a token, e.g. selected by its
+	// kid header while rotating keys. The alg header is checked against SigningAlgorithm
+	// before it is called. When set Key and PublicKey are only used for signing.
+	// Optional, by default Key or PublicKey is used.
+	KeyFunc func(token *jwt.Token) (interface{}, error)
+
+	// Key id written into the kid header of newly issued tokens.
+	// Optional, by default no kid header is set.
+	KeyID string
+
 	// Duration that a jwt token is valid. Optional, defaults to one hour.
 	Timeout time.Duration
 
+	// Callback function that returns how long the tokens of a user are valid, e.g. shorter
+	// for admins and longer for service accounts. A zero duration falls back to Timeout.
+	// Optional, by default Timeout is used for every user.
+	TimeoutFunc func(userId string) time.Duration
+
+	// Upper bound of the validity of the access tokens. Longer durations returned by
+	// TimeoutFunc are clamped to it and logged, a longer Timeout fails Init. Refresh tokens
+	// of RefreshTimeout are not affected.
+	// Optional, by default the validity isn't capped.
+	MaxTimeout time.Duration
+
 	// This field allows clients to refresh their token until MaxRefresh has passed.
 	// Note that clients can refresh their token in the last moment of MaxRefresh.
 	// This means that the maximum validity timespan for a token is MaxRefresh + Timeout.
 	// Optional, defaults to 0 meaning not refreshable.
 	MaxRefresh time.Duration
 
+	// Grace period after MaxRefresh during which RefreshHandler still refreshes tokens, but
+	// marks them with a "stale": true claim so the application can ask the user to log in
+	// again. Refreshing is refused once MaxRefresh + RefreshGrace has passed.
+	// Optional, defaults to 0 meaning no grace.
+	RefreshGrace time.Duration
+
+	// Set to true to encrypt the issued tokens as JWE so their claims can't be read by the
+	// clients, only encrypted tokens are accepted then. The signed token is encrypted with
+	// EncryptionKey using the dir algorithm and A256GCM.
+	// Optional, default is false.
+	EncryptTokens bool
+
+	// 256 bit AES key used when EncryptTokens is set.
+	EncryptionKey []byte
+
 	// Callback function that should perform the authentication of the user based on userId and
 	// password. Must return true on success, false on failure. Required.
 	Authenticator func(userId string, password string) (bool, bool, string)
 
+	// Same as Authenticator but also receives the login request, giving access to its
+	// headers, remote address and raw body, e.g. for device binding or TOTP codes.
+	// Takes precedence over Authenticator when set, one of them is required.
+	AuthenticatorWithRequest func(userId string, password string, request *rest.Request) (bool, bool, string)
+
+	// Same as AuthenticatorWithRequest but the returned error tells why the login is refused:
+	// ErrAccountDisabled gets a 403, ErrUserNotFound, ErrIncorrectPassword or any other error
+	// a 401. nil accepts the login, the token is issued for userId.
+	// Takes precedence over AuthenticatorWithRequest and Authenticator when set.
+	AuthenticatorErr func(userId string, password string, request *rest.Request) error
+
+	// Callback functions called by LoginHandler after a successful or failed authentication,
+	// e.g. to emit metrics or audit records. userId is the one sent by the client.
+	// Optional, by default nothing is called.
+	OnAuthenticated func(userId string, request *rest.Request)
+	OnAuthFailed    func(userId string, request *rest.Request)
+
+	// Callback function called by LoginHandler with the time the Authenticator took to check
+	// the credentials of userId, whatever the outcome, e.g. to feed a latency histogram.
+	// Optional, by default nothing is called.
+	OnAuthTiming func(userId string, d time.Duration)
+
+	// Callback function called by LoginHandler before the Authenticator, e.g. to lock out a
+	// user or a client address after too many failed logins. A non nil error refuses the
+	// login with a 429 carrying its message.
+	// Optional, by default logins are never throttled.
+	LoginThrottle func(userId string, request *rest.Request) error
+
+	// Callback function that should authenticate a client of ClientTokenHandler, e.g. another
+	// service, and return the scopes granted to its tokens. Must return false on failure.
+	// Optional, ClientTokenHandler replies with a 404 when unset.
+	ClientAuthenticator func(clientId string, clientSecret string) (scopes []string, ok bool)
+
 	// Callback function that should perform the authorization of the authenticated user. Called
 	// only after an authentication success. Must return true on success, false on failure.
+	// Denied requests get a 403, Unauthorized isn't called for them.
 	// Optional, default to success.
 	Authorizator func(userId string, request *rest.Request) bool
 
-	// Callback function that will be called during login.
+	// Same as Authorizator but receives all the claims of the token, e.g. to authorize based
+	// on roles set through PayloadFunc. Takes precedence over Authorizator when set.
+	AuthorizatorWithClaims func(claims map[string]interface{}, request *rest.Request) bool
+
+	// Same as AuthorizatorWithClaims but also receives the writer, and may prepare the request
+	// for the handler, e.g. set headers carrying the resolved tenant for a proxied service,
+	// values in request.Env or response headers. The handler only runs when it returns true,
+	// so changes only take effect on the success path; a denied request gets its 403 with
+	// whatever headers were set on the writer. Takes precedence over AuthorizatorWithClaims
+	// and Authorizator when set.
+	RequestAuthorizator func(writer rest.ResponseWriter, request *rest.Request, claims map[string]interface{}) bool
+
+	// Callback function that normalizes or enriches the claims of a valid token, e.g. to map
+	// the groups of an external identity provider to internal roles. Called after the
+	// signature, typ and revocation checks, the returned map replaces the claims for the
+	// identity, RequiredClaims, the Authorizator and the Env. Returning ErrForbidden refuses
+	// the request with a 403, any other error is logged and the request refused with a 401
+	// and ErrInvalidClaims.
+	// Optional.
+	ClaimsEnricher func(claims map[string]interface{}, request *rest.Request) (map[string]interface{}, error)
+
+	// Claims every token must carry to be authorized, e.g. {"scope": "admin"}. A claim
+	// matches when it equals the value or, for array claims, contains it. Numbers must be
+	// given as float64 as that's what json claims are decoded into. Checked before the
+	// Authorizator.
+	// Optional.
+	RequiredClaims map[string]interface{}
+
+	// Callback function that will be called during login and refresh.
 	// Using this function it is possible to add additional payload data to the webtoken.
 	// The data is then made available during requests via request.Env["JWT_PAYLOAD"].
 	// Note that the payload is not encrypted.
-	// The attributes mentioned on jwt.io can't be used as keys for the map.
+	// The map is applied after the standard claims, the IdentityKey and the reserved id,
+	// jti, typ, iss, aud, exp, nbf, iat, orig_iat and stale keys are skipped.
 	// Optional, by default no additional data will be set.
 	PayloadFunc func(userId string) map[string]interface{}
+
+	// TokenLookup is a string that is used to extract the token from the request:
+	//
+	//	lookup = source *("," source)
+	//	source = "header:" name [":" scheme] | "cookie:" name | "query:" name
+	//
+	// e.g. "header:Authorization", "cookie:jwt" or "query:token". A header without scheme
+	// expects TokenHeadName in front of the token, an empty scheme accepts the bare token
+	// so "header:X-Access-Token:" reads the whole value of X-Access-Token. Several sources
+	// are tried in order and the first one present in the request is used, e.g.
+	// "header:Authorization,cookie:jwt".
+	// Optional, default is "header:Authorization".
+	TokenLookup string
+
+	// Scheme expected in front of the token in the header, compared case-insensitively.
+	// Optional, default is "Bearer".
+	TokenHeadName string
+
+	// Callback function that writes the response when a request is refused, err being one
+	// of the Err* values of this package. The WWW-Authenticate header is already set when
+	// it is called.
+	// Optional, default replies with rest.Error and a 401.
+	Unauthorized func(writer rest.ResponseWriter, err error)
+
+	// Callback function that builds the JSON body written with the 401 or 403 when a request
+	// or a login is refused, err being one of the Err* values of this package. Ignored for
+	// the requests handled by Unauthorized.
+	// Optional, default body is rest.Error's {"Error": "MESSAGE"}.
+	ErrorResponse func(err error) interface{}
+
+	// Callback function that writes every error reply of the middleware and the handlers, code
+	// being the HTTP status, err the reason and message the default human readable text, e.g.
+	// to match the {"error": "..."} shape of the rest of an API. Takes precedence over
+	// ErrorResponse, Unauthorized still handles the 401 of the refused requests when set.
+	// Optional, by default ErrorResponse or rest.Error is used.
+	ErrorEncoder func(writer rest.ResponseWriter, code int, err error, message string)
+
+	// Leeway to account for clock skew between the issuing and the verifying servers.
+	// A token is accepted as long as nbf - Leeway <= now <= exp + Leeway.
+	// Optional, defaults to 0.
+	Leeway time.Duration
+
+	// Set to true to refuse the tokens whose iat claim is later than now + Leeway with
+	// ErrIssuedInFuture, which no honest issuer produces.
+	// Optional, default is false.
+	RejectFutureIat bool
+
+	// Function providing the current time, used for every timestamp written into or checked
+	// against a token or a cookie. Mostly useful to freeze the clock in tests. The key
+	// caches keep using the wall clock.
+	// Optional, default is time.Now.
+	TimeFunc func() time.Time
+
+	// Callback function that reports whether a token has been revoked, e.g. after logout.
+	// Called on every request after the signature has been validated, issued tokens carry
+	// a unique jti claim that can be used to blacklist them individually.
+	// Optional, by default no token is revoked.
+	Revoked func(claims map[string]interface{}) bool
+
+	// Callback function called by LogoutHandler with the claims of the token being logged
+	// out, e.g. to add its jti to the list checked by Revoked.
+	// Optional.
+	Revoke func(claims map[string]interface{})
+
+	// Callback function returning the time before which the tokens of the user are no
+	// longer accepted, e.g. the last password change, to log the user out everywhere.
+	// Tokens issued earlier according to their iat, or orig_iat for tokens without iat,
+	// are refused as revoked, with a one second precision. A zero time accepts every
+	// token, an error refuses the request.
+	// Optional.
+	TokenValidAfter func(userId string) (time.Time, error)
+
+	// Names of the fields LoginHandler reads the user id and password from, matched
+	// case-insensitively. Set LoginUsernameField to "username" for payloads of the form
+	// {"username": ..., "password": ...}.
+	// Optional, defaults are "email", kept for existing clients, and "password".
+	LoginUsernameField string
+	LoginPasswordField string
+
+	// Set to true to include "token_type" in the LoginHandler and RefreshHandler replies,
+	// next to "token" and "expire".
+	SendTokenType bool
+
+	// Callback function that writes the reply of a successful login in place of the default
+	// JSON body, e.g. to answer with a 201 and a Location header. The cookie of SendCookie
+	// is set beforehand. The refresh token of RefreshTimeout isn't passed, so Init refuses
+	// to have both set.
+	// Optional, by default the reply is the one described by LoginHandler.
+	LoginResponseFunc func(writer rest.ResponseWriter, token string, expire time.Time)
+
+	// By default RefreshHandler keeps the jti claim, so all tokens of a login share the
+	// same id. Set to true to give every refreshed token a new jti instead.
+	RotateJTI bool
+
+	// Issuer written into the iss claim of issued tokens. When set, tokens with a different
+	// or no iss claim are refused.
+	// Optional, by default iss is neither set nor checked.
+	Issuer string
+
+	// Audience written into the aud claim of issued tokens. When set, tokens whose aud claim,
+	// a single string or an array of strings, doesn't contain it are refused.
+	// Optional, by default aud is neither set nor checked.
+	Audience string
+
+	// Callback function returning the time from which a newly issued token is valid, written
+	// into its nbf claim. Tokens are refused before their nbf time.
+	// Optional, by default no nbf claim is set.
+	NotBeforeFunc func(userId string) time.Time
+
+	// Callback function that lets requests through without a token when it returns true,
+	// e.g. for health checks or public docs. REMOTE_USER is not set for those requests.
+	// Optional, by default every request requires a token.
+	IgnorePathFunc func(request *rest.Request) bool
+
+	// Duration that a refresh token is valid. When set, LoginHandler issues a separate long
+	// lived refresh token next to the access token, told apart by their typ claim.
+	// RefreshHandler then only accepts refresh tokens and replies with a new access token,
+	// while the middleware refuses refresh tokens. RefreshHandler must therefore not be put
+	// behind the middleware, and MaxRefresh is not used.
+	// Optional, defaults to 0 meaning a single refreshable token is issued.
+	RefreshTimeout time.Duration
+
+	// Store making the refresh tokens of RefreshTimeout single use. RefreshHandler then
+	// replies with a new refresh token next to the access token, and revokes the whole family
+	// of a refresh token presented a second time, refusing it with ErrRefreshTokenReused.
+	// Optional, by default refresh tokens can be used until they expire.
+	RefreshTokenStore RefreshTokenStore
+
+	// Set to true to have the middleware issue a new token with the response when the one of
+	// the request expires within RefreshWindow. The new token is sent in the X-Refresh-Token
+	// header, and as cookie when SendCookie is set. Requires MaxRefresh, which still bounds
+	// the session, and can't be used with RefreshTimeout, where access tokens must only be
+	// renewed with a refresh token. The service tokens of ClientTokenHandler are never
+	// refreshed.
+	// Optional, default is false.
+	AutoRefresh bool
+
+	// Remaining lifetime below which AutoRefresh issues a new token. Required for AutoRefresh.
+	RefreshWindow time.Duration
+
+	// Set to true to also send the token as an HttpOnly cookie from LoginHandler and
+	// RefreshHandler, to be read back with a TokenLookup like "cookie:jwt".
+	// Optional, default is false.
+	SendCookie bool
+
+	// Name of the cookie set when SendCookie is true.
+	// Optional, default is "jwt".
+	CookieName string
+
+	// Lifetime of the cookie set when SendCookie is true.
+	// Optional, defaults to the expiry of the token.
+	CookieMaxAge time.Duration
+
+	// Domain attribute of the cookie, e.g. "example.com" to share it between
+	// app.example.com and api.example.com.
+	// Optional, by default the cookie is only sent back to the host that set it.
+	CookieDomain string
+
+	// Path attribute of the cookie, e.g. "/".
+	// Optional, by default browsers use the directory of the login endpoint.
+	CookiePath string
+
+	// Set to true to mark the cookie as Secure so it's only sent over https.
+	// Optional, default is false.
+	SecureCookie bool
+
+	// SameSite attribute of the cookie, one of http.SameSiteLaxMode, http.SameSiteStrictMode
+	// or http.SameSiteNoneMode. The latter lets the cookie be sent by cross-site requests,
+	// e.g. from a widget embedded in a third-party page, and requires SecureCookie as
+	// browsers drop SameSite=None cookies that aren't Secure.
+	// Optional, default is http.SameSiteLaxMode.
+	CookieSameSite http.SameSite
+
+	// Value the typ claim of the tokens accepted by the middleware must have, e.g. "access"
+	// to make sure other kinds of tokens signed with the same key aren't accepted. The
+	// handlers don't check it. Unless JWKSURL is set, Init refuses values the tokens of the
+	// middleware never carry: "access" requires RefreshTimeout and "service" requires
+	// ClientAuthenticator.
+	// Optional, by default the typ claim isn't checked.
+	RequireClaimTyp string
+
+	// Name of the claim holding the user id, written on login and refresh and read into
+	// REMOTE_USER, e.g. "sub" for tokens issued by an external identity provider.
+	// Optional, default is "id".
+	IdentityKey string
+
+	// Callback function that resolves the claims of an authenticated request into an
+	// application user, stored in request.Env["REMOTE_USER"] in place of the userId.
+	// Optional, by default REMOTE_USER is the userId.
+	IdentityHandler func(claims map[string]interface{}) interface{}
+
+	// Maximum length of a token in bytes, longer ones are refused with ErrTokenTooLarge
+	// before being parsed. A negative value disables the check.
+	// Optional, default is 8KB.
+	MaxTokenLength int
+
+	// Tokens without a numeric exp claim never expire and are refused with ErrInvalidClaims.
+	// Set to true to accept them, e.g. for long lived service tokens minted elsewhere.
+	// Optional, default is false.
+	AllowMissingExpiration bool
+
+	// Logger receiving debug messages about the decisions of the middleware: accepted
+	// tokens, the reason tokens are rejected and denied authorizations.
+	// Optional, by default nothing is logged.
+	Logger Logger
+
+	// Counters of the outcomes of the requests going through the middleware.
+	// Optional, by default nothing is counted.
+	Metrics Metrics
+
+	// caches the key of KeyProvider, set by Init when KeyProviderTTL is positive
+	keyCache *cachedKey
+
+	// caches the keys of JWKSURL, set by Init
+	jwks *jwksCache
+
+	// set by Init once the configuration has been validated
+	initialized bool
 }
 
-// MiddlewareFunc makes JWTMiddleware implement the Middleware interface.
-func (mw *JWTMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+// New validates the configuration and returns a middleware with the defaults filled in.
+func New(mw JWTMiddleware) (*JWTMiddleware, error) {
+	if err := mw.Init(); err != nil {
+		return nil, err
+	}
+	return &mw, nil
+}
+
+// Init validates the configuration and fills in the defaults of the optional fields.
+// MiddlewareFunc calls it, it only needs to be called directly to check the configuration
+// upfront or when the handlers are used without the middleware.
+func (mw *JWTMiddleware) Init() error {
 
 	if mw.Realm == "" {
-		log.Fatal("Realm is required")
+		return errors.New("Realm is required")
+	}
+	if mw.SigningAlgorithm == "" && mw.JWKSURL != "" {
+		mw.SigningAlgorithm = "RS256"
 	}
 	if mw.SigningAlgorithm == "" {
-		mw.SigningAlgorithm = "HS256"
+		mw.SigningAlgorithm = defaultSigningAlgorithm
+	}
+	if !knownAlgorithm(mw.SigningAlgorithm) {
+		return errors.New("Unknown SigningAlgorithm " + mw.SigningAlgorithm)
+	}
+	for _, alg := range mw.ValidAlgorithms {
+		if !knownAlgorithm(alg) {
+			return errors.New("Unknown algorithm " + alg + " in ValidAlgorithms")
+		}
+		// there is a single PublicKey to verify them
+		if mw.KeyFunc == nil && isPublicKeyAlgorithm(alg) && alg[:2] != mw.publicAlgorithm()[:2] {
+			return errors.New("ValidAlgorithms can't mix RS* and ES* algorithms")
+		}
+	}
+	if mw.JWKSURL != "" {
+		if !mw.usingPublicKeyAlgo() || mw.acceptsHMAC() {
+			return errors.New("JWKSURL requires an RS* or ES* SigningAlgorithm")
+		}
+		if mw.JWKSRefreshInterval == 0 {
+			mw.JWKSRefreshInterval = time.Hour
+		}
+		if mw.JWKSMinRefreshInterval == 0 {
+			mw.JWKSMinRefreshInterval = time.Minute
+		}
+		mw.jwks = newJWKSCache(mw.JWKSURL, mw.JWKSRefreshInterval, mw.JWKSMinRefreshInterval)
+	} else {
+		if mw.publicAlgorithm() != "" {
+			if err := mw.readKeys(); err != nil {
+				return err
+			}
+			if mw.PublicKey == nil && mw.PrivateKey != nil {
+				mw.PublicKey = publicKeyOf(mw.PrivateKey)
+			}
+			if mw.PublicKey == nil && mw.KeyFunc == nil && !mw.TrustUpstream {
+				return errors.New("PublicKey or PrivateKey required")
+			}
+			if err := mw.checkKeyTypes(); err != nil {
+				return err
+			}
+		}
+		if mw.Key == nil && mw.KeyBase64 != "" {
+			key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(mw.KeyBase64, "="))
+			if err != nil {
+				return errors.New("Invalid KeyBase64: " + err.Error())
+			}
+			mw.Key = key
+		}
+		if mw.Key == nil && mw.KeyReader != nil {
+			key, err := ioutil.ReadAll(mw.KeyReader)
+			if err != nil {
+				return errors.New("Can't read KeyReader: " + err.Error())
+			}
+			if len(key) == 0 {
+				return errors.New("KeyReader is empty")
+			}
+			mw.Key = key
+		}
+		if mw.acceptsHMAC() && mw.Key == nil && len(mw.Keys) == 0 && mw.KeyFunc == nil && mw.KeyProvider == nil && mw.KeyForRequest == nil && !mw.TrustUpstream {
+			return errors.New("Key required")
+		}
 	}
-	if mw.Key == nil {
-		log.Fatal("Key required")
+	if mw.KeyProvider != nil && mw.KeyProviderTTL > 0 {
+		mw.keyCache = &cachedKey{}
+	}
+	if mw.EncryptTokens {
+		if _, err := newGCM(mw.EncryptionKey); err != nil {
+			return err
+		}
 	}
 	if mw.Timeout == 0 {
 		mw.Timeout = time.Hour
 	}
-	if mw.Authenticator == nil {
-		log.Fatal("Authenticator is required")
+	if mw.MaxTimeout > 0 && mw.Timeout > mw.MaxTimeout {
+		return errors.New("Timeout is larger than MaxTimeout")
+	}
+	if mw.IdentityKey == "" {
+		mw.IdentityKey = defaultIdentityKey
+	}
+	if mw.AutoRefresh && mw.RefreshWindow <= 0 {
+		return errors.New("RefreshWindow is required for AutoRefresh")
+	}
+	if mw.AutoRefresh && mw.MaxRefresh <= 0 {
+		return errors.New("MaxRefresh is required for AutoRefresh")
+	}
+	if mw.AutoRefresh && mw.RefreshTimeout != 0 {
+		return errors.New("AutoRefresh can't be used with RefreshTimeout")
+	}
+	if mw.LoginResponseFunc != nil && mw.RefreshTimeout != 0 {
+		return errors.New("LoginResponseFunc can't be used with RefreshTimeout")
+	}
+	switch mw.CookieSameSite {
+	case 0, http.SameSiteDefaultMode:
+		mw.CookieSameSite = http.SameSiteLaxMode
+	case http.SameSiteLaxMode, http.SameSiteStrictMode:
+	case http.SameSiteNoneMode:
+		if !mw.SecureCookie {
+			return errors.New("CookieSameSite None requires SecureCookie")
+		}
+	default:
+		return errors.New("Unknown CookieSameSite mode")
+	}
+	if mw.TokenLookup == "" {
+		mw.TokenLookup = defaultTokenLookup
+	}
+	if mw.TokenHeadName == "" {
+		mw.TokenHeadName = defaultTokenHeadName
+	}
+	if _, err := mw.parseTokenLookups(mw.TokenLookup); err != nil {
+		return err
+	}
+	if mw.Authenticator == nil && mw.AuthenticatorWithRequest == nil && mw.AuthenticatorErr == nil && mw.JWKSURL == "" {
+		return errors.New("Authenticator is required")
+	}
+	if mw.RequireClaimTyp != "" && mw.JWKSURL == "" && !mw.issuesTyp(mw.RequireClaimTyp) {
+		return errors.New("RequireClaimTyp " + mw.RequireClaimTyp + " is never set on the tokens of the middleware")
 	}
 	if mw.Authorizator == nil {
 		mw.Authorizator = func(userId string, request *rest.Request) bool {
@@ -78,195 +793,1852 @@ func (mw *JWTMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFu
 		}
 	}
 
-	return func(writer rest.ResponseWriter, request *rest.Request) { mw.middlewareImpl(writer, request, handler) }
+	mw.initialized = true
+	return nil
 }
 
-func (mw *JWTMiddleware) middlewareImpl(writer rest.ResponseWriter, request *rest.Request, handler rest.HandlerFunc) {
-	token, err := mw.parseToken(request)
-
-	if err != nil {
-		mw.unauthorized(writer)
-		return
+// issuesTyp reports whether some of the tokens issued by the middleware carry typ.
+func (mw *JWTMiddleware) issuesTyp(typ string) bool {
+	switch typ {
+	case accessTokenType:
+		return mw.RefreshTimeout != 0
+	case serviceTokenType:
+		return mw.ClientAuthenticator != nil
 	}
+	return false
+}
 
-	idInterface := token.Claims["id"]
+// initMu serializes the lazy initialization done by MiddlewareFunc. It lives at package
+// level so that JWTMiddleware stays copyable, New takes it by value.
+var initMu sync.Mutex
 
-	if idInterface == nil {
-		mw.unauthorized(writer)
-		return
+// MiddlewareFunc makes JWTMiddleware implement the Middleware interface.
+// Middlewares not created by New are initialized here, it panics if the configuration is
+// invalid, see Init and MiddlewareFuncChecked. It may be called concurrently to build several
+// handlers.
+func (mw *JWTMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	checked, err := mw.MiddlewareFuncChecked(handler)
+	if err != nil {
+		panic(err)
 	}
+	return checked
+}
 
-	id := idInterface.(string)
-
-	request.Env["REMOTE_USER"] = id
-	request.Env["JWT_PAYLOAD"] = token.Claims
-
-	if !mw.Authorizator(id, request) {
-		mw.unauthorized(writer)
-		return
+// MiddlewareFuncChecked is MiddlewareFunc returning the configuration error of Init instead
+// of panicking, so applications can report it their own way.
+func (mw *JWTMiddleware) MiddlewareFuncChecked(handler rest.HandlerFunc) (rest.HandlerFunc, error) {
+	if err := mw.lazyInit(); err != nil {
+		return nil, err
 	}
 
-	handler(writer, request)
+	return func(writer rest.ResponseWriter, request *rest.Request) { mw.middlewareImpl(writer, request, handler) }, nil
 }
 
-// ExtractClaims allows to retrieve the payload
-func ExtractClaims(request *rest.Request) map[string]interface{} {
-	if request.Env["JWT_PAYLOAD"] == nil {
-		emptyClaims := make(map[string]interface{})
-		return emptyClaims
+func (mw *JWTMiddleware) lazyInit() error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if mw.initialized {
+		return nil
 	}
-	jwtClaims := request.Env["JWT_PAYLOAD"].(map[string]interface{})
-	return jwtClaims
-}
-
-type ResultToken struct {
-	Token string `json:"token"`
+	return mw.Init()
 }
 
-type login struct {
-	Email    string `json:"Email"`
-	Password string `json:"password"`
-}
+func (mw *JWTMiddleware) middlewareImpl(writer rest.ResponseWriter, request *rest.Request, handler rest.HandlerFunc) {
+	if mw.IgnorePathFunc != nil && mw.IgnorePathFunc(request) {
+		handler(writer, request)
+		return
+	}
 
-// LoginHandler can be used by clients to get a jwt token.
-// Payload needs to be json in the form of {"email": "EMAIL", "password": "PASSWORD"}.
-// Reply will be of the form {"token": "TOKEN"}.
-func (mw *JWTMiddleware) LoginHandler(writer rest.ResponseWriter, request *rest.Request) {
-	loginVals := login{}
-	err := request.DecodeJsonPayload(&loginVals)
+	token, err := mw.parseToken(request)
 
 	if err != nil {
-		mw.unauthorized(writer)
+		mw.reject(writer, request, err)
 		return
 	}
 
-	isset, password, id := mw.Authenticator(loginVals.Email, loginVals.Password)
-
-	if !isset { // если пользователя не существует
-		mw.notUser(writer)
-		return
-	} else if !password { // если пароль неверный
-		mw.notPassword(writer)
+	if err := mw.checkToken(token); err != nil {
+		mw.reject(writer, request, err)
 		return
 	}
 
-	token := jwt.New(jwt.GetSigningMethod(mw.SigningAlgorithm))
+	// the token itself is left untouched, AutoRefresh must not sign the enriched claims
+	claims := token.Claims
+	if mw.ClaimsEnricher != nil {
+		claims, err = mw.ClaimsEnricher(token.Claims, request)
+		if err == ErrForbidden {
+			mw.logf("jwt: %s %s forbidden by ClaimsEnricher", request.Method, request.URL.Path)
+			mw.forbidden(writer)
+			return
+		}
+		if err != nil {
+			// the error may come from a database or a directory, it isn't shown to the client
+			mw.logf("jwt: %s %s ClaimsEnricher failed: %s", request.Method, request.URL.Path, err)
+			mw.reject(writer, request, ErrInvalidClaims)
+			return
+		}
+	}
+
+	id, err := mw.tokenIdentity(claims, token.Claims)
+	if err != nil {
+		mw.reject(writer, request, err)
+		return
+	}
 
-	if mw.PayloadFunc != nil {
-		for key, value := range mw.PayloadFunc(id) {
-			token.Claims[key] = value
+	subject := "user " + id
+	if id != "" {
+		request.Env["REMOTE_USER"] = id
+		request.Env["REMOTE_USER_ID"] = id
+		if mw.IdentityHandler != nil {
+			request.Env["REMOTE_USER"] = mw.IdentityHandler(claims)
 		}
+	} else {
+		clientId := token.Claims["client_id"].(string)
+		request.Env["REMOTE_CLIENT"] = clientId
+		subject = "client " + clientId
+	}
+	request.Env["JWT_PAYLOAD"] = claims
+	if exp, ok := claimInt64(token.Claims, "exp"); ok {
+		request.Env["JWT_EXPIRES_IN"] = time.Unix(exp, 0).Sub(mw.now())
+	}
+	request.Env["JWT_ALG"] = token.Method.Alg()
+	if kid, ok := token.Header["kid"].(string); ok {
+		request.Env["JWT_KID"] = kid
 	}
 
-	token.Claims["id"] = id
-	token.Claims["exp"] = time.Now().Add(mw.Timeout).Unix()
-	if mw.MaxRefresh != 0 {
-		token.Claims["orig_iat"] = time.Now().Unix()
+	if request.Request != nil {
+		ctx := request.Context()
+		if id != "" {
+			ctx = context.WithValue(ctx, userContextKey, id)
+		}
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		request.Request = request.WithContext(ctx)
 	}
-	tokenString, err := token.SignedString(mw.Key)
 
-	if err != nil {
-		mw.unauthorized(writer)
+	if !mw.authorize(writer, id, claims, request) {
+		mw.logf("jwt: %s %s forbidden for %s", request.Method, request.URL.Path, subject)
+		mw.forbidden(writer)
 		return
 	}
 
-	writer.Header().Add("Access-Control-Allow-Origin", "*")
-	writer.WriteJson(ResultToken{Token: tokenString})
-}
+	mw.logf("jwt: %s %s authenticated %s", request.Method, request.URL.Path, subject)
+	mw.metrics().IncSuccess()
 
-func (mw *JWTMiddleware) GenerateNewToken(id string) string {
+	if mw.AutoRefresh {
+		mw.autoRefresh(writer, request, token, id)
+	}
+
+	handler(writer, request)
+}
 
-	token := jwt.New(jwt.GetSigningMethod(mw.SigningAlgorithm))
+// checkToken refuses access tokens the middleware doesn't accept although they are valid:
+// refresh tokens, the ones without the RequireClaimTyp typ claim and the revoked ones.
+func (mw *JWTMiddleware) checkToken(token *jwt.Token) error {
+	if token.Claims["typ"] == refreshTokenType {
+		return ErrInvalidTokenType
+	}
+	if mw.RequireClaimTyp != "" && token.Claims["typ"] != mw.RequireClaimTyp {
+		return ErrInvalidTokenType
+	}
+	if mw.Revoked != nil && mw.Revoked(token.Claims) {
+		return ErrRevokedToken
+	}
+	return nil
+}
 
-	if mw.PayloadFunc != nil {
-		for key, value := range mw.PayloadFunc(id) {
-			token.Claims[key] = value
+// tokenIdentity returns the user id held by claims, tokenClaims being the claims of the token
+// before ClaimsEnricher. Tokens issued before the TokenValidAfter time are refused. The id is
+// empty for service tokens, which must hold a client id instead.
+func (mw *JWTMiddleware) tokenIdentity(claims map[string]interface{}, tokenClaims map[string]interface{}) (string, error) {
+	if tokenClaims["typ"] == serviceTokenType {
+		if _, ok := tokenClaims["client_id"].(string); !ok {
+			return "", ErrInvalidClaims
 		}
+		return "", nil
 	}
 
-	token.Claims["id"] = id
-	token.Claims["exp"] = time.Now().Add(mw.Timeout).Unix()
-	if mw.MaxRefresh != 0 {
-		token.Claims["orig_iat"] = time.Now().Unix()
+	// tokens may be issued by other services sharing the key, don't assume the claim shape
+	id, ok := claims[mw.identityKey()].(string)
+	if !ok {
+		return "", ErrInvalidClaims
+	}
+	if !mw.issuedAfterCutoff(id, tokenClaims) {
+		return "", ErrRevokedToken
 	}
-	tokenString, _ := token.SignedString(mw.Key)
+	return id, nil
+}
 
-	return tokenString
+// issuedAfterCutoff reports whether the token was issued after the TokenValidAfter time
+// of the user.
+func (mw *JWTMiddleware) issuedAfterCutoff(id string, claims map[string]interface{}) bool {
+	if mw.TokenValidAfter == nil {
+		return true
+	}
+	cutoff, err := mw.TokenValidAfter(id)
+	if err != nil {
+		mw.logf("jwt: TokenValidAfter failed for user %s: %s", id, err)
+		return false
+	}
+	if cutoff.IsZero() {
+		return true
+	}
+	iat, ok := claimInt64(claims, "iat")
+	if !ok {
+		if iat, ok = claimInt64(claims, "orig_iat"); !ok {
+			return false
+		}
+	}
+	return iat >= cutoff.Unix()
 }
 
-func (mw *JWTMiddleware) parseToken(request *rest.Request) (*jwt.Token, error) {
-	authHeader := request.Header.Get("Authorization")
+// reject logs why the request was refused and replies with a 401.
+func (mw *JWTMiddleware) reject(writer rest.ResponseWriter, request *rest.Request, err error) {
+	mw.logf("jwt: %s %s rejected: %s", request.Method, request.URL.Path, err)
+	if err == ErrExpiredToken {
+		mw.metrics().IncExpired()
+	} else {
+		mw.metrics().IncInvalid()
+	}
+	mw.unauthorized(writer, request, err)
+}
 
-	if authHeader == "" {
-		return nil, errors.New("Auth header empty")
+// logf writes to Logger, if any.
+func (mw *JWTMiddleware) logf(format string, args ...interface{}) {
+	if mw.Logger != nil {
+		mw.Logger.Printf(format, args...)
 	}
+}
 
-	parts := strings.SplitN(authHeader, " ", 2)
-	if !(len(parts) == 2 && parts[0] == "Bearer") {
-		return nil, errors.New("Invalid auth header")
+func (mw *JWTMiddleware) metrics() Metrics {
+	if mw.Metrics == nil {
+		return nopMetrics{}
 	}
+	return mw.Metrics
+}
 
-	return jwt.Parse(parts[1], func(token *jwt.Token) (interface{}, error) {
-		if jwt.GetSigningMethod(mw.SigningAlgorithm) != token.Method {
-			return nil, errors.New("Invalid signing algorithm")
-		}
-		return mw.Key, nil
-	})
+func (mw *JWTMiddleware) authorize(writer rest.ResponseWriter, id string, claims map[string]interface{}, request *rest.Request) bool {
+	if !hasRequiredClaims(claims, mw.RequiredClaims) {
+		return false
+	}
+	if mw.RequestAuthorizator != nil {
+		return mw.RequestAuthorizator(writer, request, claims)
+	}
+	if mw.AuthorizatorWithClaims != nil {
+		return mw.AuthorizatorWithClaims(claims, request)
+	}
+	return mw.Authorizator(id, request)
 }
 
-// RefreshHandler can be used to refresh a token. The token still needs to be valid on refresh.
-// Shall be put under an endpoint that is using the JWTMiddleware.
-// Reply will be of the form {"token": "TOKEN"}.
-func (mw *JWTMiddleware) RefreshHandler(writer rest.ResponseWriter, request *rest.Request) {
+// ExtractClaims validates the token of an arbitrary request the same way the middleware
+// does and returns its claims, e.g. for WebSocket upgrades or background tasks that are not
+// wrapped by the middleware. Refresh tokens, revoked tokens and tokens without identity are
+// refused as well, only ClaimsEnricher and the Authorizator are left out.
+func (mw *JWTMiddleware) ExtractClaims(request *rest.Request) (map[string]interface{}, error) {
 	token, err := mw.parseToken(request)
-
-	// Token should be valid anyway as the RefreshHandler is authed
 	if err != nil {
-		mw.unauthorized(writer)
-		return
+		return nil, err
+	}
+	if err := mw.checkToken(token); err != nil {
+		return nil, err
 	}
+	if _, err := mw.tokenIdentity(token.Claims, token.Claims); err != nil {
+		return nil, err
+	}
+	return token.Claims, nil
+}
 
-	origIat := int64(token.Claims["orig_iat"].(float64))
+// hasRequiredClaims reports whether claims match all the required values.
+func hasRequiredClaims(claims map[string]interface{}, required map[string]interface{}) bool {
+	for name, value := range required {
+		if !claimContains(claims[name], value) {
+			return false
+		}
+	}
+	return true
+}
 
-	if origIat < time.Now().Add(-mw.MaxRefresh).Unix() {
-		mw.unauthorized(writer)
-		return
+// claimInt64 reads a numeric claim. Parsed claims are float64 but claims set in-process or
+// decoded with json.Decoder.UseNumber come as integers or json.Number.
+func claimInt64(claims map[string]interface{}, key string) (int64, bool) {
+	switch value := claims[key].(type) {
+	case float64:
+		return floatToInt64(value)
+	case int64:
+		return value, true
+	case int:
+		return int64(value), true
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i, true
+		}
+		f, err := value.Float64()
+		if err != nil {
+			return 0, false
+		}
+		return floatToInt64(f)
 	}
+	return 0, false
+}
 
-	newToken := jwt.New(jwt.GetSigningMethod(mw.SigningAlgorithm))
+func floatToInt64(f float64) (int64, bool) {
+	// NaN fails both comparisons
+	if !(f >= math.MinInt64 && f < math.MaxInt64) {
+		return 0, false
+	}
+	return int64(f), true
+}
 
-	for key := range token.Claims {
-		newToken.Claims[key] = token.Claims[key]
+// HasRole reports whether the roles claim, a single string or an array of strings, contains
+// role. Meant to be used from AuthorizatorWithClaims, e.g.
+//
+//	AuthorizatorWithClaims: func(claims map[string]interface{}, request *rest.Request) bool {
+//		return jwt.HasRole(claims, "admin")
+//	},
+func HasRole(claims map[string]interface{}, role string) bool {
+	return claimContains(claims["roles"], role)
+}
+
+// claimContains reports whether claim equals value or, if it's an array, contains it.
+func claimContains(claim interface{}, value interface{}) bool {
+	if values, ok := claim.([]interface{}); ok {
+		for _, v := range values {
+			if reflect.DeepEqual(v, value) {
+				return true
+			}
+		}
+		return false
 	}
+	return claim != nil && reflect.DeepEqual(claim, value)
+}
 
-	newToken.Claims["id"] = token.Claims["id"]
-	newToken.Claims["exp"] = time.Now().Add(mw.Timeout).Unix()
-	newToken.Claims["orig_iat"] = origIat
-	tokenString, err := newToken.SignedString(mw.Key)
+// ExtractClaims allows to retrieve the payload, see ExtractClaimsFromEnv.
+func ExtractClaims(request *rest.Request) map[string]interface{} {
+	return ExtractClaimsFromEnv(request)
+}
 
-	if err != nil {
-		mw.unauthorized(writer)
-		return
+// ExtractClaimsFromEnv returns the claims the middleware stored in
+// request.Env["JWT_PAYLOAD"], or an empty map if the request wasn't authenticated.
+func ExtractClaimsFromEnv(request *rest.Request) map[string]interface{} {
+	jwtClaims, ok := request.Env["JWT_PAYLOAD"].(map[string]interface{})
+	if !ok {
+		return make(map[string]interface{})
 	}
+	return jwtClaims
+}
 
-	writer.Header().Add("Access-Control-Allow-Origin", "*")
-	writer.WriteJson(ResultToken{Token: tokenString})
+type contextKey int
+
+// keys of the values stored in the request context by the middleware
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+)
+
+// UserFromContext returns the userId stored in the request context by the middleware, ok is
+// false for requests that weren't authenticated.
+func UserFromContext(ctx context.Context) (userId string, ok bool) {
+	userId, ok = ctx.Value(userContextKey).(string)
+	return userId, ok
 }
 
-func (mw *JWTMiddleware) unauthorized(writer rest.ResponseWriter) {
-	writer.Header().Add("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("WWW-Authenticate", "JWT realm="+mw.Realm)
-	rest.Error(writer, "Пользователь не авторизован", http.StatusUnauthorized)
+// ClaimsFromContext returns the claims stored in the request context by the middleware, ok
+// is false for requests that weren't authenticated.
+func ClaimsFromContext(ctx context.Context) (claims map[string]interface{}, ok bool) {
+	claims, ok = ctx.Value(claimsContextKey).(map[string]interface{})
+	return claims, ok
 }
 
-func (mw *JWTMiddleware) notUser(writer rest.ResponseWriter) {
-	writer.Header().Add("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("WWW-Authenticate", "JWT realm="+mw.Realm)
-	rest.Error(writer, "Пользователя не существует", http.StatusUnauthorized)
+type ResultToken struct {
+	Token     string `json:"token"`
+	Expire    string `json:"expire"`
+	TokenType string `json:"token_type,omitempty"`
 }
 
-func (mw *JWTMiddleware) notPassword(writer rest.ResponseWriter) {
+// ResultTokens is the reply of LoginHandler and RefreshHandler when RefreshTimeout is set,
+// ExpiresIn being the lifetime of the access token in seconds.
+type ResultTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in"`
+	TokenType    string `json:"token_type,omitempty"`
+}
+
+// values of the typ claim when RefreshTimeout is set, and of the tokens issued by
+// ClientTokenHandler
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+	serviceTokenType = "service"
+)
+
+// LoginHandler can be used by clients to get a jwt token.
+// Payload needs to be json in the form of {"email": "EMAIL", "password": "PASSWORD"} by
+// default, the field names can be changed with LoginUsernameField and LoginPasswordField. HTML form posts
+// are read as well. Clients that can't send either may use HTTP Basic credentials instead,
+// they are only read when the payload is empty or lacks the username or password.
+// Reply will be of the form {"token": "TOKEN", "expire": "RFC3339 TIME"}, or
+// {"access_token": "TOKEN", "refresh_token": "TOKEN", "expires_in": SECONDS} when
+// RefreshTimeout is set, or the bare access token when the client accepts text/plain.
+// A payload that can't be decoded or lacks the
+// credentials gets a 400, wrong credentials a 401.
+func (mw *JWTMiddleware) LoginHandler(writer rest.ResponseWriter, request *rest.Request) {
+	if mw.JWKSURL != "" {
+		rest.NotFound(writer, request)
+		return
+	}
+
+	var body []byte
+	if mw.AuthenticatorWithRequest != nil || mw.AuthenticatorErr != nil {
+		// keep the raw body around for the callback
+		var err error
+		body, err = ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			mw.badRequest(writer, "Неверный формат запроса")
+			return
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	loginVals, err := decodeLoginPayload(request)
+
+	// an empty payload may come with Basic credentials instead
+	if err != nil && err != rest.ErrJsonPayloadEmpty {
+		mw.badRequest(writer, "Неверный формат запроса")
+		return
+	}
+
+	usernameField := mw.LoginUsernameField
+	if usernameField == "" {
+		usernameField = "email"
+	}
+	passwordField := mw.LoginPasswordField
+	if passwordField == "" {
+		passwordField = "password"
+	}
+
+	userId, userPassword := loginValue(loginVals, usernameField), loginValue(loginVals, passwordField)
+	if userId == "" || userPassword == "" {
+		if basicId, basicPassword, ok := request.BasicAuth(); ok {
+			userId, userPassword = basicId, basicPassword
+		}
+	}
+	if userId == "" || userPassword == "" {
+		if err == rest.ErrJsonPayloadEmpty {
+			mw.badRequest(writer, "Пустое тело запроса")
+			return
+		}
+		mw.badRequest(writer, "Не указан логин или пароль")
+		return
+	}
+
+	if mw.LoginThrottle != nil {
+		if err := mw.LoginThrottle(userId, request); err != nil {
+			writer.Header().Add("Access-Control-Allow-Origin", "*")
+			mw.encodeError(writer, err, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	started := time.Now()
+	id, err := mw.authenticate(userId, userPassword, body, request)
+	if mw.OnAuthTiming != nil {
+		mw.OnAuthTiming(userId, time.Since(started))
+	}
+	if err != nil {
+		if mw.OnAuthFailed != nil {
+			mw.OnAuthFailed(userId, request)
+		}
+		mw.loginFailed(writer, request, err)
+		return
+	}
+
+	if mw.OnAuthenticated != nil {
+		mw.OnAuthenticated(userId, request)
+	}
+
+	tokenString, expire, err := mw.createToken(id, request)
+
+	if err != nil {
+		mw.tokenCreationFailed(writer, request, err)
+		return
+	}
+
+	var refreshToken string
+	if mw.RefreshTimeout != 0 {
+		refreshToken, err = mw.createRefreshToken(id, "", request)
+		if err != nil {
+			mw.tokenCreationFailed(writer, request, err)
+			return
+		}
+	}
+
+	if mw.LoginResponseFunc != nil {
+		if mw.SendCookie {
+			mw.setCookie(writer, tokenString, expire)
+		}
+		writer.Header().Add("Access-Control-Allow-Origin", "*")
+		mw.LoginResponseFunc(writer, tokenString, expire)
+		return
+	}
+
+	mw.writeToken(writer, request, tokenString, refreshToken, expire)
+}
+
+// decodeLoginPayload reads the login fields from an HTML form post or, for any other
+// content type, from a JSON object.
+func decodeLoginPayload(request *rest.Request) (map[string]interface{}, error) {
+	loginVals := map[string]interface{}{}
+
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		err := request.DecodeJsonPayload(&loginVals)
+		return loginVals, err
+	}
+
+	if err := request.ParseForm(); err != nil {
+		return nil, err
+	}
+	// only the body is read, credentials don't belong in the query string
+	for field, values := range request.PostForm {
+		loginVals[field] = values[0]
+	}
+	return loginVals, nil
+}
+
+// loginValue looks up a string field of the login payload the way encoding/json matches
+// struct fields, preferring an exact match over a case-insensitive one.
+func loginValue(loginVals map[string]interface{}, field string) string {
+	if value, ok := loginVals[field].(string); ok {
+		return value
+	}
+	for key, value := range loginVals {
+		if strings.EqualFold(key, field) {
+			if value, ok := value.(string); ok {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+func (mw *JWTMiddleware) GenerateNewToken(id string) string {
+	tokenString, _, _ := mw.createToken(id, nil)
+
+	return tokenString
+}
+
+// GenerateToken issues a token for userId without going through the Authenticator, e.g.
+// once an OAuth code or an SSO assertion has been verified by the application. The token
+// carries the same claims as the ones of LoginHandler, PayloadFunc included, and is
+// returned along with its expiry. The middleware must have been initialized by New, Init
+// or MiddlewareFunc, an error is returned otherwise.
+func (mw *JWTMiddleware) GenerateToken(userId string) (string, time.Time, error) {
+	initMu.Lock()
+	initialized := mw.initialized
+	initMu.Unlock()
+	if !initialized {
+		return "", time.Time{}, errNotInitialized
+	}
+	return mw.createToken(userId, nil)
+}
+
+// errNotInitialized is returned by GenerateToken for middlewares that haven't been through
+// Init, whose Timeout would still be 0.
+var errNotInitialized = errors.New("Middleware is not initialized")
+
+// ClientTokenHandler implements the OAuth client credentials grant for service to service
+// calls. The client id and secret are read from HTTP Basic credentials, or from the
+// client_id and client_secret fields of a json or form payload, and checked by
+// ClientAuthenticator. The token holds the client id as client_id claim, "service" as typ
+// claim and the granted scopes as scope claim, to be checked with RequiredClaims or the
+// Authorizator. It has no identity so a client can't pass for the user of the same id: the
+// middleware sets request.Env["REMOTE_CLIENT"].(string) instead of REMOTE_USER and calls the
+// Authorizator with an empty userId. It can't be refreshed and PayloadFunc isn't applied. Reply is of the same form as the one
+// of LoginHandler, missing credentials get a 400 and refused ones a 401.
+func (mw *JWTMiddleware) ClientTokenHandler(writer rest.ResponseWriter, request *rest.Request) {
+	if mw.ClientAuthenticator == nil || mw.JWKSURL != "" {
+		rest.NotFound(writer, request)
+		return
+	}
+
+	clientId, clientSecret, ok := request.BasicAuth()
+	if !ok {
+		loginVals, err := decodeLoginPayload(request)
+		if err != nil && err != rest.ErrJsonPayloadEmpty {
+			mw.badRequest(writer, "Неверный формат запроса")
+			return
+		}
+		clientId, clientSecret = loginValue(loginVals, "client_id"), loginValue(loginVals, "client_secret")
+	}
+	if clientId == "" || clientSecret == "" {
+		mw.badRequest(writer, "Не указаны учётные данные клиента")
+		return
+	}
+
+	scopes, ok := mw.ClientAuthenticator(clientId, clientSecret)
+	if !ok {
+		mw.challenge(writer, request, nil)
+		mw.writeError(writer, ErrInvalidClient, "Неверные учётные данные клиента")
+		return
+	}
+
+	tokenString, expire, err := mw.createServiceToken(clientId, scopes, request)
+	if err != nil {
+		mw.tokenCreationFailed(writer, request, err)
+		return
+	}
+
+	mw.writeToken(writer, request, tokenString, "", expire)
+}
+
+// createServiceToken issues a new signed token for the client id with the granted scopes.
+func (mw *JWTMiddleware) createServiceToken(clientId string, scopes []string, request *rest.Request) (string, time.Time, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := mw.newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := mw.now()
+	expire := now.Add(mw.Timeout)
+
+	scope := make([]interface{}, len(scopes))
+	for i, s := range scopes {
+		scope[i] = s
+	}
+	token.Claims["client_id"] = clientId
+	token.Claims["jti"] = jti
+	token.Claims["typ"] = serviceTokenType
+	token.Claims["scope"] = scope
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = expire.Unix()
+	if mw.Issuer != "" {
+		token.Claims["iss"] = mw.Issuer
+	}
+	if mw.Audience != "" {
+		token.Claims["aud"] = mw.Audience
+	}
+
+	tokenString, err := mw.signToken(token, request)
+	return tokenString, expire, err
+}
+
+// createToken issues a new signed token for the user id and returns it with its expiry.
+// request is the one the token is issued for, nil if there is none.
+func (mw *JWTMiddleware) createToken(id string, request *rest.Request) (string, time.Time, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := mw.newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := mw.now()
+	expire := now.Add(mw.timeout(id))
+
+	token.Claims[mw.identityKey()] = id
+	token.Claims["jti"] = jti
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = expire.Unix()
+	if mw.RefreshTimeout != 0 {
+		token.Claims["typ"] = accessTokenType
+	}
+	if mw.Issuer != "" {
+		token.Claims["iss"] = mw.Issuer
+	}
+	if mw.Audience != "" {
+		token.Claims["aud"] = mw.Audience
+	}
+	if mw.NotBeforeFunc != nil {
+		token.Claims["nbf"] = mw.NotBeforeFunc(id).Unix()
+	}
+	if mw.MaxRefresh != 0 {
+		token.Claims["orig_iat"] = now.Unix()
+	}
+	mw.applyPayload(token, id)
+
+	tokenString, err := mw.signToken(token, request)
+	return tokenString, expire, err
+}
+
+// timeout returns the validity of the tokens issued to the user id, at most MaxTimeout.
+func (mw *JWTMiddleware) timeout(id string) time.Duration {
+	if mw.TimeoutFunc != nil {
+		if timeout := mw.TimeoutFunc(id); timeout != 0 {
+			if mw.MaxTimeout > 0 && timeout > mw.MaxTimeout {
+				mw.logf("jwt: timeout %s for user %s clamped to MaxTimeout %s", timeout, id, mw.MaxTimeout)
+				return mw.MaxTimeout
+			}
+			return timeout
+		}
+	}
+	return mw.Timeout
+}
+
+// createRefreshToken issues a new signed refresh token for the user id. family is the fam
+// claim of the refresh token it replaces, a new family is started when it's empty.
+func (mw *JWTMiddleware) createRefreshToken(id string, family string, request *rest.Request) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := mw.newToken()
+	if err != nil {
+		return "", err
+	}
+
+	token.Claims[mw.identityKey()] = id
+	token.Claims["jti"] = jti
+	token.Claims["typ"] = refreshTokenType
+	if family == "" {
+		family = jti
+	}
+	token.Claims["fam"] = family
+	now := mw.now()
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = now.Add(mw.RefreshTimeout).Unix()
+	if mw.Issuer != "" {
+		token.Claims["iss"] = mw.Issuer
+	}
+	if mw.Audience != "" {
+		token.Claims["aud"] = mw.Audience
+	}
+
+	return mw.signToken(token, request)
+}
+
+// writeToken replies with the token and its expiry, as a ResultTokens when refresh tokens
+// are enabled, refreshToken being omitted when empty. Clients asking for text/plain get the
+// bare token instead of the JSON object, unless there is a refresh token to send as well.
+func (mw *JWTMiddleware) writeToken(writer rest.ResponseWriter, request *rest.Request, tokenString string, refreshToken string, expire time.Time) {
+	var tokenType string
+	if mw.SendTokenType {
+		tokenType = mw.TokenHeadName
+		if tokenType == "" {
+			tokenType = defaultTokenHeadName
+		}
+	}
+
+	var result interface{} = ResultToken{Token: tokenString, Expire: expire.Format(time.RFC3339), TokenType: tokenType}
+	if mw.RefreshTimeout != 0 {
+		result = ResultTokens{
+			AccessToken:  tokenString,
+			RefreshToken: refreshToken,
+			ExpiresIn:    int64(math.Round(expire.Sub(mw.now()).Seconds())),
+			TokenType:    tokenType,
+		}
+	}
+
+	if mw.SendCookie {
+		mw.setCookie(writer, tokenString, expire)
+	}
+
+	writer.Header().Add("Access-Control-Allow-Origin", "*")
+	if refreshToken == "" && acceptsPlainText(request) {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		writer.(http.ResponseWriter).Write([]byte(tokenString))
+		return
+	}
+	writer.WriteJson(result)
+}
+
+// acceptsPlainText reports whether the Accept header of request lists text/plain before
+// application/json and any wildcard. Quality values are not taken into account.
+func acceptsPlainText(request *rest.Request) bool {
+	for _, accept := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		switch mediaType {
+		case "text/plain":
+			return true
+		case "application/json", "*/*", "application/*":
+			return false
+		}
+	}
+	return false
+}
+
+const defaultCookieName = "jwt"
+
+// setCookie adds the Set-Cookie header carrying the token.
+func (mw *JWTMiddleware) setCookie(writer rest.ResponseWriter, tokenString string, expire time.Time) {
+	cookie := http.Cookie{
+		Name:     mw.CookieName,
+		Value:    tokenString,
+		Expires:  expire,
+		MaxAge:   int(expire.Sub(mw.now()).Seconds()),
+		Domain:   mw.CookieDomain,
+		Path:     mw.CookiePath,
+		Secure:   mw.SecureCookie,
+		HttpOnly: true,
+		SameSite: mw.CookieSameSite,
+	}
+	if cookie.Name == "" {
+		cookie.Name = defaultCookieName
+	}
+	if mw.CookieMaxAge != 0 {
+		cookie.Expires = mw.now().Add(mw.CookieMaxAge)
+		cookie.MaxAge = int(mw.CookieMaxAge.Seconds())
+	}
+	if cookie.SameSite == 0 {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	writer.Header().Add("Set-Cookie", cookie.String())
+}
+
+// newTokenID returns a random value for the jti claim.
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// errUnknownSigningMethod is returned by newToken when SigningAlgorithm isn't supported by
+// jwt-go, which only happens for middlewares that skipped Init.
+var errUnknownSigningMethod = errors.New("Unknown signing method")
+
+// newToken creates an unsigned token for the configured algorithm and key id.
+func (mw *JWTMiddleware) newToken() (*jwt.Token, error) {
+	method := jwt.GetSigningMethod(mw.signingAlgorithm())
+	if method == nil {
+		return nil, errUnknownSigningMethod
+	}
+	token := jwt.New(method)
+	if mw.KeyID != "" {
+		token.Header["kid"] = mw.KeyID
+	}
+	return token, nil
+}
+
+// signingAlgorithm returns SigningAlgorithm, defaulted for middlewares that skipped Init.
+func (mw *JWTMiddleware) signingAlgorithm() string {
+	if mw.SigningAlgorithm == "" {
+		return defaultSigningAlgorithm
+	}
+	return mw.SigningAlgorithm
+}
+
+// reservedClaims are managed by the middleware and can't be set through PayloadFunc.
+var reservedClaims = map[string]bool{
+	"id":       true,
+	"jti":      true,
+	"typ":      true,
+	"iss":      true,
+	"aud":      true,
+	"exp":      true,
+	"nbf":      true,
+	"iat":      true,
+	"orig_iat": true,
+	"stale":    true,
+}
+
+// applyPayload merges the PayloadFunc claims into token without touching the reserved ones.
+func (mw *JWTMiddleware) applyPayload(token *jwt.Token, id string) {
+	if mw.PayloadFunc == nil {
+		return
+	}
+	for key, value := range mw.PayloadFunc(id) {
+		if reservedClaims[key] || key == mw.identityKey() {
+			continue
+		}
+		token.Claims[key] = value
+	}
+}
+
+// now returns the current time of TimeFunc, time.Now when it isn't set.
+func (mw *JWTMiddleware) now() time.Time {
+	if mw.TimeFunc == nil {
+		return time.Now()
+	}
+	return mw.TimeFunc()
+}
+
+// identityKey returns the name of the claim holding the user id.
+func (mw *JWTMiddleware) identityKey() string {
+	if mw.IdentityKey == "" {
+		return defaultIdentityKey
+	}
+	return mw.IdentityKey
+}
+
+func (mw *JWTMiddleware) parseToken(request *rest.Request) (*jwt.Token, error) {
+	tokenString, err := mw.extractToken(request)
+	if err != nil {
+		return nil, err
+	}
+	return mw.verifyToken(tokenString, request, false)
+}
+
+// parseRefreshableToken is parseToken for RefreshHandler, which accepts expired tokens as
+// long as they are still inside the MaxRefresh window.
+func (mw *JWTMiddleware) parseRefreshableToken(request *rest.Request) (*jwt.Token, error) {
+	tokenString, err := mw.extractToken(request)
+	if err != nil {
+		return nil, err
+	}
+	return mw.verifyToken(tokenString, request, true)
+}
+
+// VerifyToken parses the raw token the way the middleware does, checking its size, the
+// signature against SigningAlgorithm and the configured keys unless TrustUpstream is set,
+// its validity period, the typ header and the issuer and audience claims. The error is one of
+// the Err* values of this package.
+// Unlike the middleware it doesn't look at the identity, RequireClaimTyp, Revoked nor the
+// Authorizator.
+func (mw *JWTMiddleware) VerifyToken(tokenString string) (*jwt.Token, error) {
+	return mw.verifyToken(tokenString, nil, false)
+}
+
+// verifyToken implements VerifyToken for a token sent with request, skipping the exp check
+// when allowExpired is set.
+func (mw *JWTMiddleware) verifyToken(tokenString string, request *rest.Request, allowExpired bool) (*jwt.Token, error) {
+	var err error
+	maxLength := mw.MaxTokenLength
+	if maxLength == 0 {
+		maxLength = defaultMaxTokenLength
+	}
+	if maxLength > 0 && len(tokenString) > maxLength {
+		return nil, ErrTokenTooLarge
+	}
+
+	if mw.EncryptTokens {
+		if tokenString, err = decryptToken(tokenString, mw.EncryptionKey); err != nil {
+			return nil, ErrInvalidToken
+		}
+	}
+
+	keys, err := mw.verifyKeys(request)
+	if err != nil {
+		return nil, ErrKeyUnavailable
+	}
+
+	var keyErr error
+	var token *jwt.Token
+	for _, key := range keys {
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			// unsigned tokens are refused whatever the configuration, KeyFunc and
+			// TrustUpstream included
+			if token.Method == jwt.SigningMethodNone {
+				keyErr = ErrInvalidSigningAlgorithm
+				return nil, keyErr
+			}
+			// never trust the alg header, otherwise a public key could be used as HMAC secret
+			alg := token.Method.Alg()
+			if !mw.acceptsAlgorithm(alg) {
+				keyErr = ErrInvalidSigningAlgorithm
+				return nil, keyErr
+			}
+			if mw.TrustUpstream {
+				keyErr = errSignatureSkipped
+				return nil, keyErr
+			}
+			if mw.KeyFunc != nil {
+				return mw.KeyFunc(token)
+			}
+			if mw.jwks != nil {
+				jwksKey, err := mw.jwks.key(token)
+				if err != nil {
+					keyErr = err
+					return nil, err
+				}
+				return jwksKey, nil
+			}
+			if isPublicKeyAlgorithm(alg) {
+				return mw.PublicKey, nil
+			}
+			return key, nil
+		})
+
+		// the next key is only worth a try when this one didn't match the signature
+		if vErr, ok := err.(*jwt.ValidationError); !ok || vErr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			break
+		}
+	}
+
+	// the claims have been decoded when jwt.Parse stops at the key
+	if keyErr == errSignatureSkipped {
+		err = nil
+	}
+
+	if err != nil {
+		vErr, ok := err.(*jwt.ValidationError)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		// jwt.Parse checks exp and nbf against the wall clock without any leeway. The
+		// signature has been verified when those are the only errors, so it is safe to
+		// re-check them ourselves.
+		if vErr.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+			return nil, validationError(vErr, keyErr)
+		}
+		token.Valid = true
+	}
+
+	if err := mw.validateTime(token, allowExpired); err != nil {
+		return nil, err
+	}
+	if err := mw.validateClaims(token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// errSignatureSkipped is returned by the jwt.Keyfunc of VerifyToken with TrustUpstream so
+// jwt.Parse only decodes the token.
+var errSignatureSkipped = errors.New("Signature verification skipped")
+
+// validateTime checks exp, unless allowExpired is set, nbf and with RejectFutureIat iat
+// against TimeFunc, all of them with Leeway.
+func (mw *JWTMiddleware) validateTime(token *jwt.Token, allowExpired bool) error {
+	now := mw.now()
+	if exp, ok := claimInt64(token.Claims, "exp"); ok && !allowExpired && now.After(time.Unix(exp, 0).Add(mw.Leeway)) {
+		return ErrExpiredToken
+	}
+	if nbf, ok := claimInt64(token.Claims, "nbf"); ok && now.Add(mw.Leeway).Before(time.Unix(nbf, 0)) {
+		return ErrTokenNotValidYet
+	}
+	if iat, ok := claimInt64(token.Claims, "iat"); ok && mw.RejectFutureIat && now.Add(mw.Leeway).Before(time.Unix(iat, 0)) {
+		return ErrIssuedInFuture
+	}
+	return nil
+}
+
+// validateClaims checks the typ header and the registered claims jwt-go doesn't validate
+// itself.
+func (mw *JWTMiddleware) validateClaims(token *jwt.Token) error {
+	if !mw.validTypHeader(token.Header["typ"]) {
+		return ErrInvalidTokenType
+	}
+	if _, ok := claimInt64(token.Claims, "exp"); !ok && !mw.AllowMissingExpiration {
+		return ErrInvalidClaims
+	}
+	if mw.Issuer != "" && token.Claims["iss"] != mw.Issuer {
+		return ErrInvalidIssuer
+	}
+	if mw.Audience != "" && !containsAudience(token.Claims["aud"], mw.Audience) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+// validTypHeader reports whether the typ header is JWT or missing, as it's optional. With
+// JWKSURL the RFC 9068 at+jwt of the access tokens of identity providers is accepted too.
+func (mw *JWTMiddleware) validTypHeader(header interface{}) bool {
+	if header == nil {
+		return true
+	}
+	typ, _ := header.(string)
+	if strings.EqualFold(typ, "JWT") {
+		return true
+	}
+	return mw.JWKSURL != "" && (strings.EqualFold(typ, "at+jwt") || strings.EqualFold(typ, "application/at+jwt"))
+}
+
+// containsAudience reports whether the aud claim, a string or an array, contains audience.
+func containsAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validationError maps a jwt-go validation error to the matching Err* value.
+func validationError(vErr *jwt.ValidationError, keyErr error) error {
+	switch {
+	case vErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return ErrMalformedToken
+	case vErr.Errors&jwt.ValidationErrorUnverifiable != 0 && keyErr != nil:
+		return keyErr
+	case vErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return ErrInvalidSignature
+	case vErr.Errors&jwt.ValidationErrorExpired != 0:
+		return ErrExpiredToken
+	case vErr.Errors&jwt.ValidationErrorNotValidYet != 0:
+		return ErrTokenNotValidYet
+	}
+	return ErrInvalidToken
+}
+
+// extractToken locates the raw token string as configured by TokenLookup.
+func (mw *JWTMiddleware) extractToken(request *rest.Request) (string, error) {
+	// the handlers may be used without MiddlewareFunc having set the defaults
+	lookup := mw.TokenLookup
+	if lookup == "" {
+		lookup = defaultTokenLookup
+	}
+
+	sources, err := mw.parseTokenLookups(lookup)
+	if err != nil {
+		return "", err
+	}
+
+	var missingErr error
+	for _, source := range sources {
+		token, err := extractTokenFrom(request, source)
+		if err == ErrMissingAuthHeader || err == ErrTokenNotFound {
+			// report the first source when the token is in none of them
+			if missingErr == nil {
+				missingErr = err
+			}
+			continue
+		}
+		return token, err
+	}
+	return "", missingErr
+}
+
+// extractTokenFrom looks for the token in a single source.
+func extractTokenFrom(request *rest.Request, source tokenSource) (string, error) {
+	switch source.kind {
+	case "cookie":
+		cookie, err := request.Cookie(source.name)
+		if err != nil || cookie.Value == "" {
+			return "", ErrTokenNotFound
+		}
+		return cookie.Value, nil
+	case "query":
+		token := request.URL.Query().Get(source.name)
+		if token == "" {
+			return "", ErrTokenNotFound
+		}
+		return token, nil
+	}
+
+	authHeader := strings.TrimSpace(request.Header.Get(source.name))
+
+	if authHeader == "" {
+		return "", ErrMissingAuthHeader
+	}
+
+	if source.scheme == "" {
+		return authHeader, nil
+	}
+
+	// sloppy clients send "bearer" or several spaces before the token
+	parts := strings.Fields(authHeader)
+	if !(len(parts) == 2 && strings.EqualFold(parts[0], source.scheme)) {
+		return "", ErrInvalidAuthHeader
+	}
+
+	return parts[1], nil
+}
+
+// parseTokenLookups parses the comma separated entries of TokenLookup.
+func (mw *JWTMiddleware) parseTokenLookups(lookup string) ([]tokenSource, error) {
+	var sources []tokenSource
+	for _, entry := range strings.Split(lookup, ",") {
+		source, err := mw.parseTokenLookup(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// tokenSource is a parsed TokenLookup entry.
+type tokenSource struct {
+	kind   string
+	name   string
+	scheme string
+}
+
+func (mw *JWTMiddleware) parseTokenLookup(lookup string) (tokenSource, error) {
+	parts := strings.SplitN(lookup, ":", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return tokenSource{}, errors.New("TokenLookup must be of the form <source>:<name>")
+	}
+
+	source := tokenSource{kind: parts[0], name: parts[1]}
+	switch source.kind {
+	case "header":
+		if len(parts) == 3 {
+			source.scheme = parts[2]
+		} else if mw.TokenHeadName != "" {
+			source.scheme = mw.TokenHeadName
+		} else {
+			source.scheme = defaultTokenHeadName
+		}
+	case "cookie", "query":
+		if len(parts) == 3 {
+			return tokenSource{}, errors.New("Only header sources take a scheme in TokenLookup")
+		}
+	default:
+		return tokenSource{}, errors.New("Unknown TokenLookup source " + source.kind)
+	}
+	return source, nil
+}
+
+func (mw *JWTMiddleware) usingPublicKeyAlgo() bool {
+	return isPublicKeyAlgorithm(mw.SigningAlgorithm)
+}
+
+func isPublicKeyAlgorithm(alg string) bool {
+	return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "ES")
+}
+
+func knownAlgorithm(alg string) bool {
+	switch alg {
+	case "HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512":
+		return true
+	}
+	return false
+}
+
+// acceptsAlgorithm reports whether tokens signed with alg are verified, alg being either
+// SigningAlgorithm or one of ValidAlgorithms.
+func (mw *JWTMiddleware) acceptsAlgorithm(alg string) bool {
+	if alg == mw.signingAlgorithm() {
+		return true
+	}
+	for _, valid := range mw.ValidAlgorithms {
+		if alg == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsHMAC reports whether any of the accepted algorithms verifies with Key.
+func (mw *JWTMiddleware) acceptsHMAC() bool {
+	if !mw.usingPublicKeyAlgo() {
+		return true
+	}
+	for _, alg := range mw.ValidAlgorithms {
+		if !isPublicKeyAlgorithm(alg) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAlgorithm returns the accepted algorithm PublicKey and PrivateKey are used for,
+// SigningAlgorithm if it's an RS* or ES* one. Empty when only HMAC is accepted.
+func (mw *JWTMiddleware) publicAlgorithm() string {
+	if mw.usingPublicKeyAlgo() {
+		return mw.SigningAlgorithm
+	}
+	for _, alg := range mw.ValidAlgorithms {
+		if isPublicKeyAlgorithm(alg) {
+			return alg
+		}
+	}
+	return ""
+}
+
+// readKeys parses the PEM encoded keys into PrivateKey and PublicKey. Key objects take
+// precedence over PEM strings, which take precedence over files.
+func (mw *JWTMiddleware) readKeys() error {
+	if mw.PrivateKey == nil {
+		data, source, err := mw.readPEM(mw.PrivKeyPEM, "PrivKeyPEM", mw.PrivKeyReader, "PrivKeyReader", mw.PrivKeyFile, "PrivKeyFile")
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			if mw.PrivateKey, err = mw.parsePrivateKey(data); err != nil {
+				return errors.New("Invalid " + source + ": " + err.Error())
+			}
+		}
+	}
+	if mw.PublicKey == nil {
+		data, source, err := mw.readPEM(mw.PubKeyPEM, "PubKeyPEM", mw.PubKeyReader, "PubKeyReader", mw.PubKeyFile, "PubKeyFile")
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			if mw.PublicKey, err = mw.parsePublicKey(data); err != nil {
+				return errors.New("Invalid " + source + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// readPEM returns the PEM string if set, else the content of the reader or of the file,
+// along with the name of the option it came from. data is nil when none is set.
+func (mw *JWTMiddleware) readPEM(pemString, pemOption string, reader io.Reader, readerOption string, path, fileOption string) ([]byte, string, error) {
+	if pemString != "" {
+		return []byte(pemString), pemOption, nil
+	}
+	if reader != nil {
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, readerOption, errors.New("Can't read " + readerOption + ": " + err.Error())
+		}
+		return data, readerOption, nil
+	}
+	if path == "" {
+		return nil, "", nil
+	}
+	var data []byte
+	var err error
+	if mw.KeyFS != nil {
+		data, err = fs.ReadFile(mw.KeyFS, path)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fileOption, errors.New("Can't read " + fileOption + ": " + err.Error())
+	}
+	return data, fileOption + " " + path, nil
+}
+
+// parsePrivateKey decodes a PEM private key of the public algorithm family.
+func (mw *JWTMiddleware) parsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	var key crypto.PrivateKey
+	var err error
+	if strings.HasPrefix(mw.publicAlgorithm(), "RS") {
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	} else {
+		key, err = jwt.ParseECPrivateKeyFromPEM(data)
+	}
+	// don't leave a typed nil pointer behind in the interface
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parsePublicKey decodes a PEM public key of the public algorithm family.
+func (mw *JWTMiddleware) parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	var key crypto.PublicKey
+	var err error
+	if strings.HasPrefix(mw.publicAlgorithm(), "RS") {
+		key, err = jwt.ParseRSAPublicKeyFromPEM(data)
+	} else {
+		key, err = jwt.ParseECPublicKeyFromPEM(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkKeyTypes makes sure the configured key pair fits the public algorithm family.
+func (mw *JWTMiddleware) checkKeyTypes() error {
+	alg := mw.publicAlgorithm()
+	var privateOk, publicOk bool
+	if strings.HasPrefix(alg, "RS") {
+		_, privateOk = mw.PrivateKey.(*rsa.PrivateKey)
+		_, publicOk = mw.PublicKey.(*rsa.PublicKey)
+	} else {
+		_, privateOk = mw.PrivateKey.(*ecdsa.PrivateKey)
+		_, publicOk = mw.PublicKey.(*ecdsa.PublicKey)
+	}
+	if mw.PrivateKey != nil && !privateOk {
+		return errors.New("PrivateKey doesn't match the signing algorithm " + alg)
+	}
+	if mw.PublicKey != nil && !publicOk {
+		return errors.New("PublicKey doesn't match the signing algorithm " + alg)
+	}
+	return nil
+}
+
+func publicKeyOf(key crypto.PrivateKey) crypto.PublicKey {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	}
+	return nil
+}
+
+// signToken signs token, and encrypts it when EncryptTokens is set.
+func (mw *JWTMiddleware) signToken(token *jwt.Token, request *rest.Request) (string, error) {
+	signingKey, err := mw.signingKey(request)
+	if err != nil {
+		return "", err
+	}
+
+	tokenString, err := token.SignedString(signingKey)
+	if err != nil || !mw.EncryptTokens {
+		return tokenString, err
+	}
+	return encryptToken(tokenString, mw.EncryptionKey)
+}
+
+// signingKey returns the key handed to SignedString for the configured algorithm.
+func (mw *JWTMiddleware) signingKey(request *rest.Request) (interface{}, error) {
+	if mw.usingPublicKeyAlgo() {
+		return mw.PrivateKey, nil
+	}
+	if mw.KeyForRequest != nil {
+		return mw.requestKey(request)
+	}
+	if mw.KeyProvider != nil {
+		return mw.providedKey()
+	}
+	if len(mw.Keys) != 0 {
+		return mw.Keys[0], nil
+	}
+	return mw.Key, nil
+}
+
+// verifyKey returns the key used to check token signatures for the configured algorithm.
+func (mw *JWTMiddleware) verifyKey() interface{} {
+	if mw.usingPublicKeyAlgo() {
+		return mw.PublicKey
+	}
+	return mw.Key
+}
+
+// verifyKeys returns the candidate keys tried in turn to check the signature of a token sent
+// with request.
+func (mw *JWTMiddleware) verifyKeys(request *rest.Request) ([]interface{}, error) {
+	if !mw.acceptsHMAC() || mw.KeyFunc != nil {
+		return []interface{}{mw.verifyKey()}, nil
+	}
+	if mw.KeyForRequest != nil {
+		key, err := mw.requestKey(request)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{key}, nil
+	}
+	if mw.KeyProvider != nil {
+		key, err := mw.providedKey()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{key}, nil
+	}
+	if len(mw.Keys) == 0 {
+		return []interface{}{mw.Key}, nil
+	}
+	keys := make([]interface{}, len(mw.Keys))
+	for i, key := range mw.Keys {
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// errNoRequest is returned by requestKey when there is no request to pick the key for.
+var errNoRequest = errors.New("KeyForRequest requires a request")
+
+// requestKey returns the key of KeyForRequest for request.
+func (mw *JWTMiddleware) requestKey(request *rest.Request) ([]byte, error) {
+	if request == nil {
+		return nil, errNoRequest
+	}
+	return mw.KeyForRequest(request)
+}
+
+// cachedKey holds the last key returned by KeyProvider.
+type cachedKey struct {
+	mu      sync.Mutex
+	key     []byte
+	fetched time.Time
+}
+
+// providedKey returns the key of KeyProvider, cached for KeyProviderTTL.
+func (mw *JWTMiddleware) providedKey() ([]byte, error) {
+	if mw.keyCache == nil {
+		return mw.KeyProvider()
+	}
+
+	mw.keyCache.mu.Lock()
+	defer mw.keyCache.mu.Unlock()
+	if mw.keyCache.key != nil && time.Since(mw.keyCache.fetched) < mw.KeyProviderTTL {
+		return mw.keyCache.key, nil
+	}
+	key, err := mw.KeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	mw.keyCache.key, mw.keyCache.fetched = key, time.Now()
+	return key, nil
+}
+
+// RefreshHandler can be used to refresh a token. The token must have a valid signature and
+// claims, but may have expired as long as orig_iat + MaxRefresh hasn't passed, so clients can
+// renew a token that expired while they were idle. Shall be put under an endpoint that is
+// using the JWTMiddleware, unless RefreshTimeout is set in which case it expects a refresh
+// token and must not be behind the middleware. Expired tokens only reach it when it isn't
+// behind the middleware either.
+// Reply will be of the same form as the one of LoginHandler, refresh_token being only set
+// with RefreshTokenStore.
+func (mw *JWTMiddleware) RefreshHandler(writer rest.ResponseWriter, request *rest.Request) {
+	if mw.JWKSURL != "" {
+		rest.NotFound(writer, request)
+		return
+	}
+
+	if mw.MaxRefresh == 0 && mw.RefreshTimeout == 0 {
+		mw.unauthorized(writer, request, ErrRefreshDisabled)
+		return
+	}
+
+	var token *jwt.Token
+	var err error
+	if mw.RefreshTimeout != 0 {
+		token, err = mw.parseToken(request)
+	} else {
+		token, err = mw.parseRefreshableToken(request)
+	}
+
+	// Token should be valid anyway as the RefreshHandler is authed, but the handler
+	// may also be mounted without the middleware in front of it
+	if err != nil {
+		mw.unauthorized(writer, request, err)
+		return
+	}
+
+	if mw.RefreshTimeout != 0 {
+		mw.refreshAccessToken(writer, request, token)
+		return
+	}
+
+	origIat, ok := claimInt64(token.Claims, "orig_iat")
+	if !ok {
+		mw.unauthorized(writer, request, ErrInvalidClaims)
+		return
+	}
+
+	id, ok := token.Claims[mw.identityKey()].(string)
+	if !ok {
+		mw.unauthorized(writer, request, ErrInvalidClaims)
+		return
+	}
+
+	// the middleware isn't necessarily in front of the handler to check these
+	if mw.Revoked != nil && mw.Revoked(token.Claims) || !mw.issuedAfterCutoff(id, token.Claims) {
+		mw.unauthorized(writer, request, ErrRevokedToken)
+		return
+	}
+
+	// refreshing is allowed as long as orig_iat + MaxRefresh lies in the future, and
+	// flagged as stale during the grace period after it
+	deadline := time.Unix(origIat, 0).Add(mw.MaxRefresh)
+	if deadline.Add(mw.RefreshGrace).Before(mw.now()) {
+		mw.unauthorized(writer, request, ErrRefreshExpired)
+		return
+	}
+	if deadline.Before(mw.now()) {
+		token.Claims["stale"] = true
+	} else {
+		delete(token.Claims, "stale")
+	}
+
+	tokenString, expire, err := mw.refreshToken(token, id, origIat, request)
+
+	if err != nil {
+		mw.tokenCreationFailed(writer, request, err)
+		return
+	}
+
+	mw.writeToken(writer, request, tokenString, "", expire)
+}
+
+// refreshToken signs a copy of token with a new expiry. origIat is kept unless it's 0.
+func (mw *JWTMiddleware) refreshToken(token *jwt.Token, id string, origIat int64, request *rest.Request) (string, time.Time, error) {
+	newToken, err := mw.newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	for key := range token.Claims {
+		newToken.Claims[key] = token.Claims[key]
+	}
+
+	// tokens issued before jti was introduced get one as well
+	if _, ok := newToken.Claims["jti"].(string); !ok || mw.RotateJTI {
+		jti, err := newTokenID()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		newToken.Claims["jti"] = jti
+	}
+
+	now := mw.now()
+	expire := now.Add(mw.timeout(id))
+	// a refresh never shortens the session, even if the clock went backwards
+	if exp, ok := claimInt64(token.Claims, "exp"); ok && expire.Before(time.Unix(exp, 0)) {
+		expire = time.Unix(exp, 0)
+	}
+
+	newToken.Claims[mw.identityKey()] = id
+	newToken.Claims["iat"] = now.Unix()
+	newToken.Claims["exp"] = expire.Unix()
+	if mw.Issuer != "" {
+		newToken.Claims["iss"] = mw.Issuer
+	}
+	if mw.Audience != "" {
+		newToken.Claims["aud"] = mw.Audience
+	}
+	if origIat != 0 {
+		newToken.Claims["orig_iat"] = origIat
+	}
+	mw.applyPayload(newToken, id)
+
+	tokenString, err := mw.signToken(newToken, request)
+	return tokenString, expire, err
+}
+
+// autoRefresh sets the X-Refresh-Token header, and the cookie if SendCookie is set, to a
+// new token when the current one expires within RefreshWindow. Service tokens are left alone.
+func (mw *JWTMiddleware) autoRefresh(writer rest.ResponseWriter, request *rest.Request, token *jwt.Token, id string) {
+	if token.Claims["typ"] == serviceTokenType {
+		return
+	}
+
+	exp, ok := claimInt64(token.Claims, "exp")
+	if !ok || time.Unix(exp, 0).Sub(mw.now()) > mw.RefreshWindow {
+		return
+	}
+
+	// Init makes sure MaxRefresh is set, so sessions can't be extended forever
+	origIat, ok := claimInt64(token.Claims, "orig_iat")
+	if !ok || time.Unix(origIat, 0).Add(mw.MaxRefresh).Before(mw.now()) {
+		return
+	}
+
+	tokenString, expire, err := mw.refreshToken(token, id, origIat, request)
+	if err != nil {
+		mw.logf("jwt: automatic refresh for user %s failed: %s", id, err)
+		return
+	}
+
+	writer.Header().Set(refreshTokenHeader, tokenString)
+	if mw.SendCookie {
+		mw.setCookie(writer, tokenString, expire)
+	}
+}
+
+// refreshAccessToken issues a new access token in exchange for a refresh token.
+func (mw *JWTMiddleware) refreshAccessToken(writer rest.ResponseWriter, request *rest.Request, token *jwt.Token) {
+	if token.Claims["typ"] != refreshTokenType {
+		mw.unauthorized(writer, request, ErrInvalidTokenType)
+		return
+	}
+
+	id, ok := token.Claims[mw.identityKey()].(string)
+	if !ok {
+		mw.unauthorized(writer, request, ErrInvalidClaims)
+		return
+	}
+
+	if mw.Revoked != nil && mw.Revoked(token.Claims) || !mw.issuedAfterCutoff(id, token.Claims) {
+		mw.unauthorized(writer, request, ErrRevokedToken)
+		return
+	}
+
+	var family string
+	if mw.RefreshTokenStore != nil {
+		jti, _ := token.Claims["jti"].(string)
+		family, _ = token.Claims["fam"].(string)
+		if jti == "" || family == "" {
+			mw.unauthorized(writer, request, ErrInvalidClaims)
+			return
+		}
+		if !mw.RefreshTokenStore.Consume(jti, family) {
+			mw.logf("jwt: refresh token %s of user %s reused, revoking its family", jti, id)
+			mw.RefreshTokenStore.RevokeFamily(family)
+			mw.unauthorized(writer, request, ErrRefreshTokenReused)
+			return
+		}
+	}
+
+	tokenString, expire, err := mw.createToken(id, request)
+	if err != nil {
+		mw.tokenCreationFailed(writer, request, err)
+		return
+	}
+
+	var refreshToken string
+	if mw.RefreshTokenStore != nil {
+		refreshToken, err = mw.createRefreshToken(id, family, request)
+		if err != nil {
+			mw.tokenCreationFailed(writer, request, err)
+			return
+		}
+	}
+
+	mw.writeToken(writer, request, tokenString, refreshToken, expire)
+}
+
+// LogoutHandler clears the cookie set by SendCookie and replies with a 200. If Revoke is
+// set it's called with the claims of the token sent with the request, if any is valid.
+// Can be put under an endpoint with or without the JWTMiddleware in front of it.
+func (mw *JWTMiddleware) LogoutHandler(writer rest.ResponseWriter, request *rest.Request) {
+	if mw.Revoke != nil {
+		if token, err := mw.parseToken(request); err == nil {
+			mw.Revoke(token.Claims)
+		}
+	}
+
+	// Domain, Path and SameSite must match the ones of the login for browsers to drop the cookie
+	cookie := http.Cookie{
+		Name:     mw.CookieName,
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		Domain:   mw.CookieDomain,
+		Path:     mw.CookiePath,
+		Secure:   mw.SecureCookie,
+		HttpOnly: true,
+		SameSite: mw.CookieSameSite,
+	}
+	if cookie.Name == "" {
+		cookie.Name = defaultCookieName
+	}
+	if cookie.SameSite == 0 {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	writer.Header().Add("Set-Cookie", cookie.String())
+	writer.Header().Add("Access-Control-Allow-Origin", "*")
+	writer.WriteHeader(http.StatusOK)
+}
+
+// authenticate checks the credentials with the configured Authenticator and returns the
+// identity of the user. The bool forms are reported as ErrUserNotFound or
+// ErrIncorrectPassword.
+func (mw *JWTMiddleware) authenticate(userId, userPassword string, body []byte, request *rest.Request) (string, error) {
+	if mw.AuthenticatorErr != nil {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return userId, mw.AuthenticatorErr(userId, userPassword, request)
+	}
+
+	var isset, password bool
+	var id string
+	if mw.AuthenticatorWithRequest != nil {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		isset, password, id = mw.AuthenticatorWithRequest(userId, userPassword, request)
+	} else {
+		isset, password, id = mw.Authenticator(userId, userPassword)
+	}
+
+	if !isset { // если пользователя не существует
+		return "", ErrUserNotFound
+	} else if !password { // если пароль неверный
+		return "", ErrIncorrectPassword
+	}
+	return id, nil
+}
+
+// loginFailed replies to a login the Authenticator refused with err.
+func (mw *JWTMiddleware) loginFailed(writer rest.ResponseWriter, request *rest.Request, err error) {
+	switch err {
+	case ErrUserNotFound:
+		mw.notUser(writer, request)
+	case ErrIncorrectPassword:
+		mw.notPassword(writer, request)
+	case ErrAccountDisabled:
+		writer.Header().Add("Access-Control-Allow-Origin", "*")
+		mw.writeErrorStatus(writer, err, "Учётная запись отключена", http.StatusForbidden)
+	default:
+		mw.challenge(writer, request, nil)
+		mw.writeError(writer, err, "Пользователь не авторизован")
+	}
+}
+
+// unauthorized replies with a 401, err being the reason the request was refused.
+func (mw *JWTMiddleware) unauthorized(writer rest.ResponseWriter, request *rest.Request, err error) {
+	mw.challenge(writer, request, err)
+	if mw.Unauthorized != nil {
+		mw.Unauthorized(writer, err)
+		return
+	}
+	mw.writeError(writer, err, "Пользователь не авторизован")
+}
+
+// forbidden replies with a 403 to an authenticated user the Authorizator denied.
+func (mw *JWTMiddleware) forbidden(writer rest.ResponseWriter) {
+	mw.metrics().IncForbidden()
+	writer.Header().Add("Access-Control-Allow-Origin", "*")
+	mw.writeErrorStatus(writer, ErrForbidden, "Доступ запрещён", http.StatusForbidden)
+}
+
+// tokenCreationFailed replies with a 500 for a misconfigured signing method, a 401 with
+// ErrFailedTokenCreation otherwise.
+func (mw *JWTMiddleware) tokenCreationFailed(writer rest.ResponseWriter, request *rest.Request, err error) {
+	if err == errUnknownSigningMethod {
+		mw.logf("jwt: can't sign tokens with %s", mw.SigningAlgorithm)
+		writer.Header().Add("Access-Control-Allow-Origin", "*")
+		mw.encodeError(writer, err, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	mw.unauthorized(writer, request, ErrFailedTokenCreation)
+}
+
+// badRequest replies with a 400 for a login payload the client got wrong.
+func (mw *JWTMiddleware) badRequest(writer rest.ResponseWriter, message string) {
+	writer.Header().Add("Access-Control-Allow-Origin", "*")
+	mw.encodeError(writer, ErrInvalidLoginPayload, message, http.StatusBadRequest)
+}
+
+func (mw *JWTMiddleware) notUser(writer rest.ResponseWriter, request *rest.Request) {
+	mw.challenge(writer, request, nil)
+	mw.writeError(writer, ErrUserNotFound, "Пользователя не существует")
+}
+
+func (mw *JWTMiddleware) notPassword(writer rest.ResponseWriter, request *rest.Request) {
+	mw.challenge(writer, request, nil)
+	mw.writeError(writer, ErrIncorrectPassword, "Неверный пароль")
+}
+
+// writeError writes the 401 body, built by ErrorResponse when set and from message otherwise.
+func (mw *JWTMiddleware) writeError(writer rest.ResponseWriter, err error, message string) {
+	mw.writeErrorStatus(writer, err, message, http.StatusUnauthorized)
+}
+
+func (mw *JWTMiddleware) writeErrorStatus(writer rest.ResponseWriter, err error, message string, code int) {
+	if mw.ErrorResponse == nil || mw.ErrorEncoder != nil {
+		mw.encodeError(writer, err, message, code)
+		return
+	}
+	writer.WriteHeader(code)
+	writer.WriteJson(mw.ErrorResponse(err))
+}
+
+// encodeError writes an error reply with ErrorEncoder when set and rest.Error otherwise.
+func (mw *JWTMiddleware) encodeError(writer rest.ResponseWriter, err error, message string, code int) {
+	if mw.ErrorEncoder != nil {
+		mw.ErrorEncoder(writer, code, err, message)
+		return
+	}
+	rest.Error(writer, message, code)
+}
+
+var realmEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// challenge sets the RFC 6750 WWW-Authenticate header. A missing token gets the bare
+// challenge, a token that was sent but refused is reported as invalid_token with err as
+// error_description.
+func (mw *JWTMiddleware) challenge(writer rest.ResponseWriter, request *rest.Request, err error) {
+	realm := mw.Realm
+	if mw.RealmFunc != nil {
+		realm = mw.RealmFunc(request)
+	}
+	value := `Bearer realm="` + realmEscaper.Replace(realm) + `"`
+	if isTokenError(err) {
+		value += `, error="invalid_token", error_description="` + realmEscaper.Replace(err.Error()) + `"`
+	}
 	writer.Header().Add("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("WWW-Authenticate", "JWT realm="+mw.Realm)
-	rest.Error(writer, "Неверный пароль", http.StatusUnauthorized)
+	writer.Header().Set("WWW-Authenticate", value)
+}
+
+// isTokenError reports whether err was caused by a token that was sent but refused.
+func isTokenError(err error) bool {
+	switch err {
+	case nil, ErrMissingAuthHeader, ErrTokenNotFound, ErrKeyUnavailable, ErrRefreshDisabled, ErrForbidden, ErrInvalidLoginPayload, ErrFailedTokenCreation:
+		return false
+	}
+	return true
 }
@@ -0,0 +1,100 @@
+package jwt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// jweHeader is the protected header of the tokens encrypted with EncryptionKey, the key is
+// used directly as content encryption key.
+const jweHeader = `{"alg":"dir","enc":"A256GCM","cty":"JWT"}`
+
+var encodedJWEHeader = base64.RawURLEncoding.EncodeToString([]byte(jweHeader))
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("EncryptionKey must be 32 bytes long for A256GCM")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptToken wraps the signed tokenString in a RFC 7516 compact JWE.
+func encryptToken(tokenString string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	// the protected header is authenticated as additional data
+	sealed := gcm.Seal(nil, iv, []byte(tokenString), []byte(encodedJWEHeader))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		encodedJWEHeader,
+		"", // no encrypted key with dir
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decryptToken returns the signed token wrapped in the compact JWE tokenString. Only dir
+// and A256GCM are supported, compressed payloads are refused.
+func decryptToken(tokenString string, key []byte) (string, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return "", errors.New("Token is not a dir JWE")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+		Zip string `json:"zip"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "dir" || header.Enc != "A256GCM" || header.Zip != "" {
+		return "", errors.New("Unsupported JWE header " + string(headerJSON))
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	var decoded [3][]byte
+	for i, part := range parts[2:] {
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return "", err
+		}
+	}
+	iv, ciphertext, tag := decoded[0], decoded[1], decoded[2]
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return "", errors.New("Invalid JWE initialization vector or tag")
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,101 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"strings"
+	"testing"
+)
+
+var encryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedTokens(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:         "test zone",
+		Key:           key,
+		EncryptTokens: true,
+		EncryptionKey: encryptionKey,
+		Authenticator: func(userId string, password string) (bool, bool, string) {
+			return true, true, userId
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"ssn": "078-05-1120"}
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	apiRouter, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]interface{}{"ssn": ExtractClaims(r)["ssn"]})
+		}),
+	)
+	api.SetApp(apiRouter)
+	handler := api.MakeHandler()
+
+	loginCreds := map[string]string{"email": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+	result := ResultToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &result)
+
+	parts := strings.Split(result.Token, ".")
+	if len(parts) != 5 || parts[0] != encodedJWEHeader || parts[1] != "" {
+		t.Fatalf("Login should issue a dir JWE, got %s", result.Token)
+	}
+	for _, part := range parts {
+		decoded, _ := base64.RawURLEncoding.DecodeString(part)
+		if strings.Contains(string(decoded), "078-05-1120") {
+			t.Error("Claims should not be readable from the encrypted token")
+		}
+	}
+
+	run := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded = run(result.Token)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"ssn":"078-05-1120"}`)
+
+	// tampering with the ciphertext breaks the authentication tag
+	tampered := append([]string{}, parts...)
+	ciphertext, _ := base64.RawURLEncoding.DecodeString(tampered[3])
+	ciphertext[0] ^= 1
+	tampered[3] = base64.RawURLEncoding.EncodeToString(ciphertext)
+	run(strings.Join(tampered, ".")).CodeIs(401)
+
+	// signed only tokens are refused
+	run(makeTokenString("admin", key)).CodeIs(401)
+
+	// the inner token is still checked, even when encrypted with the right key
+	forged, _ := encryptToken(makeTokenString("admin", []byte("sekret key")), encryptionKey)
+	run(forged).CodeIs(401)
+}
+
+func TestEncryptionKeySize(t *testing.T) {
+	if _, err := New(JWTMiddleware{
+		Realm:         "test zone",
+		Key:           key,
+		EncryptTokens: true,
+		EncryptionKey: []byte("too short"),
+		Authenticator: func(userId string, password string) (bool, bool, string) {
+			return true, true, userId
+		},
+	}); err == nil {
+		t.Error("EncryptionKey of the wrong size should fail New")
+	}
+
+	if _, err := decryptToken(encodedJWEHeader+"..AA.AA.AA", encryptionKey); err == nil {
+		t.Error("JWE with a short initialization vector should be refused")
+	}
+}
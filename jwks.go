@@ -0,0 +1,238 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksClient fetches the JWKS documents, it doesn't wait forever on a stuck provider.
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwksCache holds the public keys of a JWKS document by kid.
+type jwksCache struct {
+	url string
+	// age after which the document is fetched again
+	refreshInterval time.Duration
+	// minimum delay between two fetches, whatever triggers them
+	minInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	// closed once the fetch in flight completes, nil when there is none
+	fetching chan struct{}
+}
+
+func newJWKSCache(url string, refreshInterval, minInterval time.Duration) *jwksCache {
+	return &jwksCache{url: url, refreshInterval: refreshInterval, minInterval: minInterval}
+}
+
+// key returns the public key matching the kid header of token. The document is fetched
+// on first use, once it's older than refreshInterval, and when the kid is unknown in case
+// the keys have been rotated. Only the first fetch and the ones for unknown kids are waited
+// for, the current keys are used while a stale document is fetched again.
+func (c *jwksCache) key(token *jwt.Token) (crypto.PublicKey, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	c.mu.Lock()
+	now := time.Now()
+	if c.keys == nil || now.Sub(c.fetched) >= c.refreshInterval {
+		if done := c.refresh(now); done != nil && c.keys == nil {
+			c.wait(done)
+		}
+	}
+	if c.keys == nil {
+		c.mu.Unlock()
+		return nil, ErrKeyUnavailable
+	}
+
+	key, ok := c.keys[kid]
+	if !ok {
+		if done := c.refresh(now); done != nil {
+			c.wait(done)
+			key, ok = c.keys[kid]
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	// the key must fit the alg header, which has been checked against SigningAlgorithm
+	switch key.(type) {
+	case *rsa.PublicKey:
+		ok = strings.HasPrefix(token.Method.Alg(), "RS")
+	case *ecdsa.PublicKey:
+		ok = strings.HasPrefix(token.Method.Alg(), "ES")
+	}
+	if !ok {
+		return nil, ErrInvalidSigningAlgorithm
+	}
+	return key, nil
+}
+
+// refresh starts fetching the document in the background unless the last attempt is more
+// recent than minInterval, so tokens with made up kids can't be used to hammer the provider.
+// The current keys are kept when the fetch fails. Returns the channel closed once the fetch,
+// or the one already in flight, completes, nil if there is none. c.mu must be held.
+func (c *jwksCache) refresh(now time.Time) chan struct{} {
+	if c.fetching != nil {
+		return c.fetching
+	}
+	if !c.attempted.IsZero() && now.Sub(c.attempted) < c.minInterval {
+		return nil
+	}
+	c.attempted = now
+
+	done := make(chan struct{})
+	c.fetching = done
+	go func() {
+		// the provider is called without holding c.mu, a slow one doesn't stall the checks
+		keys, err := fetchJWKS(c.url)
+		c.mu.Lock()
+		if err == nil {
+			c.keys, c.fetched = keys, now
+		}
+		c.fetching = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// wait releases c.mu until done is closed. c.mu must be held.
+func (c *jwksCache) wait(done chan struct{}) {
+	c.mu.Unlock()
+	<-done
+	c.mu.Lock()
+}
+
+// fetchJWKS downloads and parses the JWKS document at url.
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected JWKS response status " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// jsonWebKey is a RFC 7517 public key, only the RSA and EC members are decoded.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes the signing keys of a JWKS document. Encryption keys and key types
+// other than RSA and EC are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch jwk.Kty {
+		case "RSA":
+			key, err = jwk.rsaPublicKey()
+		case "EC":
+			key, err = jwk.ecdsaPublicKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.New("Invalid JWKS key " + jwk.Kid + ": " + err.Error())
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeKeyParam(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeKeyParam(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("RSA exponent is too large")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (jwk jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch jwk.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.New("Unsupported curve " + jwk.Crv)
+	}
+	x, err := decodeKeyParam(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeKeyParam(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("Point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// decodeKeyParam decodes a base64url encoded big-endian integer.
+func decodeKeyParam(param string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("Missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
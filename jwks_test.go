@@ -0,0 +1,407 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func encodeKeyParam(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   encodeKeyParam(key.N),
+		"e":   encodeKeyParam(big.NewInt(int64(key.E))),
+	}
+}
+
+func ecdsaJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": key.Curve.Params().Name,
+		"x":   encodeKeyParam(key.X),
+		"y":   encodeKeyParam(key.Y),
+	}
+}
+
+// serveJWKS starts a server replying with the JWKS document returned by keys.
+func serveJWKS(keys func() []map[string]string) (*httptest.Server, *int) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys()})
+	}))
+	return server, &fetches
+}
+
+// settle waits for the fetch of the JWKS document in flight, if any.
+func settle(c *jwksCache) {
+	c.mu.Lock()
+	done := c.fetching
+	c.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+func signWithKid(alg string, kid string, key interface{}) string {
+	token := jwt.New(jwt.GetSigningMethod(alg))
+	token.Header["kid"] = kid
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, _ := token.SignedString(key)
+	return tokenString
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, fetches := serveJWKS(func() []map[string]string {
+		encryptionKey := rsaJWK("enc", &otherKey.PublicKey)
+		encryptionKey["use"] = "enc"
+		return []map[string]string{
+			rsaJWK("rsa", &rsaKey.PublicKey),
+			encryptionKey,
+			{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+		}
+	})
+	defer server.Close()
+
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:   "test zone",
+		JWKSURL: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authMiddleware.SigningAlgorithm != "RS256" {
+		t.Errorf("SigningAlgorithm should default to RS256, got %s", authMiddleware.SigningAlgorithm)
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	apiRouter, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]interface{}{"user": r.Env["REMOTE_USER"]})
+		}),
+	)
+	api.SetApp(apiRouter)
+	handler := api.MakeHandler()
+
+	run := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded := run(signWithKid("RS256", "rsa", rsaKey))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"user":"admin"}`)
+
+	run(signWithKid("RS256", "rsa", otherKey)).CodeIs(401)
+	run(signWithKid("RS256", "enc", otherKey)).CodeIs(401)
+	run(signWithKid("HS256", "secret", []byte("secret"))).CodeIs(401)
+
+	if *fetches != 1 {
+		t.Errorf("JWKS should be fetched once, got %d fetches", *fetches)
+	}
+
+	if _, err := authMiddleware.parseToken(makeRestRequest("Bearer " + signWithKid("RS256", "unknown", rsaKey))); err != ErrUnknownKey {
+		t.Errorf("Unknown kid should be refused with %s, got %v", ErrUnknownKey, err)
+	}
+
+	loginCreds := map[string]string{"email": "admin", "password": "admin"}
+	test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds)).CodeIs(404)
+}
+
+func TestJWKSECDSA(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := serveJWKS(func() []map[string]string {
+		return []map[string]string{ecdsaJWK("ec", &ecKey.PublicKey), rsaJWK("rsa", &rsaKey.PublicKey)}
+	})
+	defer server.Close()
+
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "ES256",
+		JWKSURL:          server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := authMiddleware.parseToken(makeRestRequest("Bearer " + signWithKid("ES256", "ec", ecKey))); err != nil {
+		t.Errorf("Token signed with the EC key should verify, got %s", err)
+	}
+
+	// an RSA key is never used for ES256 even if the kid points at it
+	if _, err := authMiddleware.parseToken(makeRestRequest("Bearer " + signWithKid("ES256", "rsa", ecKey))); err != ErrInvalidSigningAlgorithm {
+		t.Errorf("Key of the wrong type should be refused with %s, got %v", ErrInvalidSigningAlgorithm, err)
+	}
+
+	if _, err := New(JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "HS256",
+		JWKSURL:          server.URL,
+	}); err == nil {
+		t.Error("JWKSURL with an HMAC algorithm should fail New")
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:   "test zone",
+		JWKSURL: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authMiddleware.parseToken(makeRestRequest("Bearer " + signWithKid("RS256", "rsa", rsaKey))); err != ErrKeyUnavailable {
+		t.Errorf("Failing JWKS should be reported as %s, got %v", ErrKeyUnavailable, err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	if _, err := parseJWKS([]byte(`{"keys": [{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`)); err == nil {
+		t.Error("EC point off the curve should be refused")
+	}
+	if _, err := parseJWKS([]byte(`{"keys": [{"kty": "RSA", "kid": "bad", "n": "", "e": "AQAB"}]}`)); err == nil {
+		t.Error("RSA key without modulus should be refused")
+	}
+	if _, err := parseJWKS([]byte(`not json`)); err == nil {
+		t.Error("Malformed document should be refused")
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := []map[string]string{rsaJWK("old", &oldKey.PublicKey)}
+	server, fetches := serveJWKS(func() []map[string]string {
+		return published
+	})
+	defer server.Close()
+
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:   "test zone",
+		JWKSURL: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(tokenString string) error {
+		_, err := authMiddleware.parseToken(makeRestRequest("Bearer " + tokenString))
+		return err
+	}
+	// pretends the last fetch happened longer ago than d
+	age := func(d time.Duration) {
+		authMiddleware.jwks.fetched = authMiddleware.jwks.fetched.Add(-d)
+		authMiddleware.jwks.attempted = authMiddleware.jwks.attempted.Add(-d)
+	}
+
+	if err := parse(signWithKid("RS256", "old", oldKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider rotates its key, the unknown kid triggers a fetch
+	published = []map[string]string{rsaJWK("new", &newKey.PublicKey), rsaJWK("old", &oldKey.PublicKey)}
+	age(time.Minute * 2)
+	if err := parse(signWithKid("RS256", "new", newKey)); err != nil {
+		t.Errorf("Token with the rotated kid should verify after a refresh, got %s", err)
+	}
+	if *fetches != 2 {
+		t.Errorf("Unknown kid should trigger one fetch, got %d fetches", *fetches)
+	}
+
+	// bogus kids right after don't cause more fetches
+	for i := 0; i < 3; i++ {
+		if err := parse(signWithKid("RS256", "bogus", newKey)); err != ErrUnknownKey {
+			t.Errorf("Bogus kid should be refused with %s, got %v", ErrUnknownKey, err)
+		}
+	}
+	if *fetches != 2 {
+		t.Errorf("Refetches should be rate limited, got %d fetches", *fetches)
+	}
+
+	// the document is refreshed periodically in the background, dropping the retired key
+	published = []map[string]string{rsaJWK("new", &newKey.PublicKey)}
+	age(time.Hour)
+	if err := parse(signWithKid("RS256", "new", newKey)); err != nil {
+		t.Errorf("Current keys should be used while the document is fetched again, got %s", err)
+	}
+	settle(authMiddleware.jwks)
+	if err := parse(signWithKid("RS256", "old", oldKey)); err != ErrUnknownKey {
+		t.Errorf("Retired key should be refused after the periodic refresh, got %v", err)
+	}
+	if *fetches != 3 {
+		t.Errorf("Stale document should be fetched again, got %d fetches", *fetches)
+	}
+
+	// a failing provider leaves the known keys in place
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	age(time.Hour)
+	parse(signWithKid("RS256", "new", newKey))
+	settle(authMiddleware.jwks)
+	if err := parse(signWithKid("RS256", "new", newKey)); err != nil {
+		t.Errorf("Known keys should survive a failed refresh, got %s", err)
+	}
+}
+
+func TestJWKSSlowRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	slow := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("rsa", &rsaKey.PublicKey)}})
+	}))
+	defer server.Close()
+
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:   "test zone",
+		JWKSURL: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func() error {
+		_, err := authMiddleware.parseToken(makeRestRequest("Bearer " + signWithKid("RS256", "rsa", rsaKey)))
+		return err
+	}
+	if err := parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider hangs on the periodic refresh, tokens are still checked meanwhile
+	slow = true
+	authMiddleware.jwks.mu.Lock()
+	authMiddleware.jwks.fetched = authMiddleware.jwks.fetched.Add(-time.Hour * 2)
+	authMiddleware.jwks.attempted = authMiddleware.jwks.attempted.Add(-time.Hour * 2)
+	authMiddleware.jwks.mu.Unlock()
+
+	checked := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { checked <- parse() }()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-checked:
+			if err != nil {
+				t.Errorf("Cached key should verify during the refresh, got %s", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Token check should not wait for the refresh")
+		}
+	}
+	close(release)
+	settle(authMiddleware.jwks)
+}
+
+func TestJWKSTypHeader(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := serveJWKS(func() []map[string]string {
+		return []map[string]string{rsaJWK("rsa", &rsaKey.PublicKey)}
+	})
+	defer server.Close()
+
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:   "test zone",
+		JWKSURL: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(typ interface{}) string {
+		token := jwt.New(jwt.GetSigningMethod("RS256"))
+		token.Header["kid"] = "rsa"
+		if typ == nil {
+			delete(token.Header, "typ")
+		} else {
+			token.Header["typ"] = typ
+		}
+		token.Claims["id"] = "admin"
+		token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, _ := token.SignedString(rsaKey)
+		return tokenString
+	}
+
+	// identity providers often leave typ out or use the RFC 9068 one
+	for _, typ := range []interface{}{nil, "at+jwt", "application/at+jwt", "JWT"} {
+		if _, err := authMiddleware.parseToken(makeRestRequest("Bearer " + sign(typ))); err != nil {
+			t.Errorf("typ header %v should be accepted, got %s", typ, err)
+		}
+	}
+	if _, err := authMiddleware.parseToken(makeRestRequest("Bearer " + sign("JWE"))); err != ErrInvalidTokenType {
+		t.Errorf("typ header JWE should be refused with %s, got %v", ErrInvalidTokenType, err)
+	}
+}